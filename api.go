@@ -1,38 +1,52 @@
 package xdb
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"time"
 )
 
-// Put 将(idxK,value)键值对保存到数据库中
+// Put 将(idxK,value)键值对保存到数据库中；数据库未打开或已关闭时返回ErrClosed，key不能以BucketKeyPrefix开头(ReservedPrefix返回的前缀除外)
 func Put(key, value string) error {
 	if key == "" || value == "" {
 		return fmt.Errorf("idxK, value can not be empty, idxK: %s, value: %s", key, value)
 	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	return dbEngine.putInternal(key, value)
+}
+
+// putInternal 写入(key,value)，不检查key是否保留给引擎内部使用
+func (engine *DBEngine) putInternal(key, value string) error {
+	stored, codecID, keyID, err := engine.encodeVal(key, value)
+	if err != nil {
+		return err
+	}
 	seg := &Segment{
-		value: value,
+		value: stored,
 		Hint: Hint{
 			key:   key,
 			keysz: len(key),
 			val: val{
 				tm:     time.Now().UnixNano(),
-				valsz:  len(value),
+				valsz:  len(stored),
 				valops: 0,
+				codec:  codecID,
+				keyID:  keyID,
 			},
 		},
 	}
 	// 将数据写入文件
-	err := dbEngine.appendSeg(seg)
-	if err != nil {
-		slogger.Fatalf("write seg to file: %s error: %v", dbEngine.segFName, err)
+	err = engine.appendSeg(seg)
+	if err != nil && !errors.Is(err, ErrClosed) {
+		slogger.Fatalf("write seg to file: %s error: %v", engine.segFName, err)
 	}
-	// 更新索引
-	seg.valops = dbEngine.segFLen(dbEngine.segFName) - int64(NewLineSize+seg.valsz)
-	dbEngine.updMemIdx(segment2MemIndex(seg, dbEngine.segFName))
-	return nil
+	return err
 }
 
 // Query 从数据库中查找key对应的value并返回
@@ -40,19 +54,37 @@ func Query(key string) (string, error) {
 	if key == "" {
 		return "", fmt.Errorf("%s", "idxK can not be empty")
 	}
-	indexValue, ok := dbEngine.memIdx[key]
+	if err := dbEngine.checkOpen(); err != nil {
+		return "", err
+	}
+	indexValue, ok := dbEngine.getMemIdx(key)
 	if ok {
-		return seekKey(dbEngine.dataDir, indexValue)
+		return dbEngine.seekKey(key, indexValue)
 	}
 	slogger.Infof("get idxK: %s, no memIdx exist\n", key)
 	return "", nil
 }
 
-// Remove 从数据库中删除key对应的记录
+// Remove 从数据库中删除key对应的记录，key的限制同Put
 func Remove(key string) error {
 	if key == "" {
 		return fmt.Errorf("idxK, value can not be empty, idxK: %s", key)
 	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	return dbEngine.removeInternal(key)
+}
+
+// removeInternal 删除key，不检查key是否保留给引擎内部使用
+func (engine *DBEngine) removeInternal(key string) error {
+	keyID, err := engine.crypt.currentKeyID()
+	if err != nil {
+		return err
+	}
 	// 将数据写入文件
 	seg := &Segment{
 		Hint: Hint{
@@ -61,61 +93,199 @@ func Remove(key string) error {
 			val: val{
 				tm:     time.Now().UnixNano(),
 				valops: 0,
+				keyID:  keyID,
 			},
 		},
 	}
-	err := dbEngine.appendSeg(seg)
-	if err != nil {
-		log.Fatalf("write seg to file: %s error: %v", dbEngine.segFName, err)
+	err = engine.appendSeg(seg)
+	if err != nil && !errors.Is(err, ErrClosed) {
+		slogger.Fatalf("write seg to file: %s error: %v", engine.segFName, err)
 	}
-	// 更新索引
-	dbEngine.updMemIdx(segment2MemIndex(seg, dbEngine.segFName))
-	return nil
+	return err
 }
 
 // Open 启动数据库引擎，dataDir指定数据库数据存放目录，若不指定目录则默认：/Users/majunqiang/Documents/mrxdbengine/data/
-func Open(dataDir string) {
-	dbEngine = &DBEngine{
-		dataDir: DataDir,
-		memIdx:  make(map[string]MemIdxV),
-	}
-	// 1. 设置数据目录
-	if dataDir != "" {
-		dbEngine.dataDir = dataDir
-	}
-	// 2. 获取数据文件夹下所有的段文件，按照时间戳倒序排列
-	segFs := getDataFs(dbEngine.dataDir, SegFNamePrefix, 1)
-	if len(segFs) > 0 {
-		// 3. 设置当前活跃段文件
-		fName := segFs[0].Name()
-		dbEngine.segFName = fName
+// 数据目录已被其他进程打开时返回ErrLocked，数据文件格式版本高于当前引擎支持的版本时返回ErrUnsupportedVersion
+func Open(dataDir string) error {
+	return OpenWithOptions(Options{DataDir: dataDir})
+}
+
+// OpenWithOptions 按照opts配置启动数据库引擎，未设置的配置项使用默认值
+func OpenWithOptions(opts Options) error {
+	opts = opts.withDefaults()
+	if err := useCodec(opts.Codec); err != nil {
+		return err
+	}
+	secIdxs, err := newSecIdxs(opts.Indexes)
+	if err != nil {
+		return err
+	}
+	engine := &DBEngine{
+		dataDir:           opts.DataDir,
+		codec:             opts.Codec,
+		crypt:             newCryptor(opts.KeyProvider),
+		compressThreshold: opts.CompressThreshold,
+		blobThreshold:     opts.BlobThreshold,
+		retention:         opts.Retention,
+		memIdx:            make(map[string]MemIdxV),
+		keySets:           make(map[string]map[string]struct{}),
+		secIdxs:           secIdxs,
+		snaps:             make(map[uint64]*DBSnapshot),
+		watchers:          make(map[uint64]*watcher),
+	}
+	// 1. 设置数据目录，并对数据目录加锁
+	if err := os.MkdirAll(engine.dataDir, FileMode); err != nil {
+		return fmt.Errorf("create dataDir: %s error: %v", engine.dataDir, err)
+	}
+	lockF, err := lockDir(engine.dataDir)
+	if err != nil {
+		return err
+	}
+	engine.lockF = lockF
+	// 2. 加载数据文件清单，清单中的段文件按照时间戳倒序排列
+	m, err := openManifest(engine.dataDir)
+	if err != nil {
+		unlockDir(lockF)
+		return fmt.Errorf("open manifest error: %v", err)
+	}
+	engine.manifest = m
+	// 检查数据文件格式版本，拒绝打开不支持的版本，并将旧格式的数据文件迁移为当前格式
+	if err = engine.migrate(); err != nil {
+		m.close()
+		unlockDir(lockF)
+		return fmt.Errorf("migrate data files error: %w", err)
+	}
+	segFs := m.liveFs(SegFNamePrefix)
+	// 3. 设置当前活跃段文件：最新的段文件未达到大小上限或尚未生成hint文件时继续追加写入，否则首次写入时创建新的段文件
+	if len(segFs) > 0 && (engine.segFLen(segFs[0]) < SegSizeLimit || !engine.isExistCompF(segFs[0], SegFNamePrefix)) {
+		fName := segFs[0]
+		engine.segFName = fName
+		engine.segFHinted = engine.isExistCompF(fName, SegFNamePrefix)
 		slogger.Infof("active segment file: %s\n", fName)
-		// 4. 从段文件生成内存索引,若段文件有对应的hint file,则使用hint file生成内存索引
-		dbEngine.genMemIdx(segFs)
+		// 若活跃段文件尾部存在写入中断导致的残缺记录，截断残缺数据
+		recovery, err := engine.recoverSegF(fName)
+		if err != nil {
+			m.close()
+			unlockDir(lockF)
+			return fmt.Errorf("recover active segment file: %s error: %v", fName, err)
+		}
+		if recovery != nil {
+			slogger.Warnf("active segment file: %s truncated to %d bytes, %d bytes moved to quarantine file: %s",
+				fName, recovery.ValidSize, recovery.TruncatedBytes, recovery.QuarantineFName)
+		}
+		engine.recovery = recovery
+	}
+	// 4. 优先使用内存索引快照恢复索引，否则从段文件生成内存索引,若段文件有对应的hint file,则使用hint file生成内存索引
+	snap, err := engine.loadIdxSnap()
+	if err != nil {
+		slogger.Errorf("load index snapshot error, rebuild index from segment files: %v", err)
+	}
+	if snap == nil || !engine.restoreIdxSnap(snap, segFs) {
+		engine.memIdx = make(map[string]MemIdxV)
+		engine.seq = 0
+		engine.genMemIdx(segFs)
+	}
+	drops := engine.initKeySets()
+	// 序列号取MANIFEST记录值与数据文件中最大值二者中的较大值，保证不会回退
+	if m.seq > engine.seq {
+		engine.seq = m.seq
 	}
-	// 5. 启动完成
+	// 启用历史版本保留策略时，扫描数据文件加载历史版本
+	if engine.retention.enabled() {
+		if err = engine.loadVersions(segFs); err != nil {
+			m.close()
+			unlockDir(lockF)
+			return fmt.Errorf("load versions error: %v", err)
+		}
+	}
+	// 清除已删除桶中的key，构建新注册的二级索引
+	engine.purgeDropped(drops)
+	if err = engine.buildIndexes(); err != nil {
+		m.close()
+		unlockDir(lockF)
+		return fmt.Errorf("build indexes error: %v", err)
+	}
+	// 5. 启动完成，定期保存内存索引快照
+	engine.stopCh = make(chan struct{})
+	engine.bgWg.Add(1)
+	go engine.checkpoint()
+	dbEngine = engine
 	slogger.Infof("dbEngine start success!")
+	return nil
 }
 
-// ListKey 返回当前数据库中所有有效的
+// ListKey 返回当前数据库中所有有效的key，数据库未打开或已关闭时返回空列表
 func ListKey(key string) []string {
 	keys := make([]string, 0)
+	if dbEngine.checkOpen() != nil {
+		return keys
+	}
+	dbEngine.memIdxMu.RLock()
+	defer dbEngine.memIdxMu.RUnlock()
 	for k, _ := range dbEngine.memIdx {
-		keys = append(keys, k)
+		// 桶中的key通过DBBucket.ListKey获取
+		if !isInternalKey(k) {
+			keys = append(keys, k)
+		}
 	}
 	return keys
 }
 
+// Compact 立即为已冻结的段文件生成hint文件并执行段合并，返回时段合并已经完成；可合并的段文件数量不足MaxSegmentNum时不合并
+func Compact() error {
+	engine := dbEngine
+	if err := engine.checkOpen(); err != nil {
+		return err
+	}
+	for _, segFName := range engine.freezeSegFs() {
+		engine.hintFrozenSegF(segFName)
+	}
+	engine.segMerge()
+	return nil
+}
+
 // Sync 将写入数据的数据刷新到磁盘
 func Sync() {
 
 }
 
-// Close 关闭当前数据库引擎
-func Close() {
+// Close 关闭当前数据库引擎，为尚未生成hint文件的段文件(包括活跃段文件)生成hint文件，释放尚未释放的快照，保存内存索引快照，并释放数据目录锁
+// 关闭之后数据库的读写返回ErrClosed；重复调用Close无副作用
+func Close() error {
+	engine := dbEngine
+	if engine == nil || !engine.closed.CompareAndSwap(false, true) {
+		return nil
+	}
 	// 执行Sync刷盘
 	Sync()
-	// 退出
-	slogger.Infoln("db xdb will exit.")
-	os.Exit(0)
+	close(engine.stopCh)
+	engine.bgWg.Wait()
+	// 等待正在进行的段合并和写入完成
+	engine.segMergeMu.Lock()
+	defer engine.segMergeMu.Unlock()
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	for _, segFName := range engine.manifest.liveFs(SegFNamePrefix) {
+		if engine.isExistCompF(segFName, SegFNamePrefix) {
+			continue
+		}
+		if err := engine.writeHintF(segFName); err != nil {
+			slogger.Errorf("write hint file for segment: %s error: %v", segFName, err)
+		}
+	}
+	// 释放尚未释放的快照，关闭全部订阅
+	engine.releaseSnaps()
+	engine.closeWatchers()
+	// 保存内存索引快照，加速下次启动
+	if err := engine.saveIdxSnap(engine.captureIdxSnap()); err != nil {
+		slogger.Errorf("save index snapshot error: %v", err)
+	}
+	if err := engine.manifest.close(); err != nil {
+		return fmt.Errorf("close manifest error: %v", err)
+	}
+	if err := unlockDir(engine.lockF); err != nil {
+		return fmt.Errorf("unlock data dir: %s error: %v", engine.dataDir, err)
+	}
+	slogger.Infoln("db xdb closed.")
+	return nil
 }
@@ -0,0 +1,294 @@
+package xdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// blob 文件：value(压缩、加密后)长度超过blobThreshold的记录，value保存在blob文件中，段文件中只保存指向blob文件的指针(KindBlob记录)，
+// 段合并时只需复制指针，不再复制value；blob文件独立进行垃圾回收
+// blob 文件记录格式：crc(8B) | seq | codec | keyID | keysz | valsz | key | value | \n，记录长度由keysz、valsz确定，value中可以包含任意字符
+// 流式写入的blob记录在写入value时尚未分配序列号，头部的seq为0，记录的序列号以段文件中的指针记录为准
+
+// blobPtr 指向blob文件中value的指针
+type blobPtr struct {
+	fName  string // blob文件名称
+	valops int64  // value 在blob文件中的位置
+	valsz  int    // value 长度
+}
+
+// encodeBlobPtr 将blob指针按格式编码
+func encodeBlobPtr(ptr blobPtr) (string, error) {
+	tm, err := parseTm(Delimiter, ptr.fName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(BlobPtrFormat, tm, ptr.valops, ptr.valsz), nil
+}
+
+// decodeBlobPtr 从KindBlob记录的value中解析blob指针
+func decodeBlobPtr(data string) (blobPtr, error) {
+	ptr := blobPtr{}
+	var tm int64
+	if len(data) != BlobPtrSize {
+		return ptr, fmt.Errorf("bad blob pointer: %s", data)
+	}
+	if _, err := fmt.Sscanf(data, BlobPtrFormat, &tm, &ptr.valops, &ptr.valsz); err != nil {
+		return ptr, fmt.Errorf("decode blob pointer: %s error: %v", data, err)
+	}
+	ptr.fName = fmt.Sprintf(DataFNameFormat, BlobFNamePrefix, tm)
+	return ptr, nil
+}
+
+// encodeBlob 将记录的key、value按格式编码为blob文件记录，头部增加CRC校验值
+func encodeBlob(seg *Segment, storedKey string) string {
+	dataStr := fmt.Sprintf(BlobFormat, seg.seq, seg.codec, seg.keyID, len(storedKey), len(seg.value), storedKey, seg.value)
+	return fmt.Sprintf(CRCFormat, crc(dataStr), dataStr)
+}
+
+// readBlob 从blob文件中读取一条记录，返回的记录中key为加密后的key；同时返回记录长度
+func readBlob(reader *bufio.Reader) (*Segment, int, error) {
+	header := make([]byte, BlobRecHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+	seg := &Segment{}
+	if _, err := fmt.Sscanf(string(header), "%08x%016x%02x%08x%02x%08x", &seg.crcVal, &seg.seq, &seg.codec, &seg.keyID, &seg.keysz, &seg.valsz); err != nil {
+		return nil, 0, fmt.Errorf("decode blob header: %s error: %v", header, err)
+	}
+	body := make([]byte, seg.keysz+seg.valsz+NewLineSize)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, 0, err
+	}
+	if !checkCRC(string(header[8:])+string(body[:len(body)-NewLineSize]), seg.crcVal) {
+		return nil, 0, fmt.Errorf("crc broken,blob header: %s,crc: %d", header, seg.crcVal)
+	}
+	seg.key = string(body[:seg.keysz])
+	seg.value = string(body[seg.keysz : seg.keysz+seg.valsz])
+	return seg, len(header) + len(body), nil
+}
+
+// writeBlob 将记录的value写入当前活跃blob文件，返回blob指针；调用方需持有segFMu
+// 若不存在活跃blob文件，或者当前blob文件大小超过限制，则创建新的blob文件，并对冻结的blob文件进行垃圾回收
+func (engine *DBEngine) writeBlob(seg *Segment) (string, error) {
+	if engine.blobFName == "" || engine.segFLen(engine.blobFName) >= BlobSizeLimit {
+		blobFName, err := engine.newDataF(DataFNameFormat, BlobFNamePrefix, time.Now().UnixNano())
+		if err != nil {
+			return "", err
+		}
+		if err = engine.manifest.commit([]string{blobFName}, nil); err != nil {
+			return "", fmt.Errorf("record blob file: %s to manifest error: %v", blobFName, err)
+		}
+		frozenFName := engine.blobFName
+		engine.blobFName = blobFName
+		slogger.Infof("new blob file created, active blob file: %s\n", blobFName)
+		if frozenFName != "" {
+			go engine.blobGC()
+		}
+	}
+	storedKey, err := engine.crypt.sealKey(seg.keyID, seg.key)
+	if err != nil {
+		return "", err
+	}
+	blobF, err := os.OpenFile(path.Join(engine.dataDir, engine.blobFName), os.O_APPEND|os.O_WRONLY, FileMode)
+	if err != nil {
+		return "", fmt.Errorf("open blob file: %s error: %v", engine.blobFName, err)
+	}
+	defer blobF.Close()
+	offset := engine.segFLen(engine.blobFName)
+	dataStr := encodeBlob(seg, storedKey)
+	if _, err = blobF.WriteString(dataStr); err != nil {
+		return "", fmt.Errorf("write blob file: %s error: %v", engine.blobFName, err)
+	}
+	return encodeBlobPtr(blobPtr{
+		fName:  engine.blobFName,
+		valops: offset + int64(len(dataStr)-NewLineSize-len(seg.value)),
+		valsz:  len(seg.value),
+	})
+}
+
+// seekBlob 根据KindBlob记录中的blob指针，从blob文件中读取value
+func (engine *DBEngine) seekBlob(ptrStr string) ([]byte, error) {
+	ptr, err := decodeBlobPtr(ptrStr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path.Join(engine.dataDir, ptr.fName), os.O_RDONLY, FileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open blob file: %s error: %v", ptr.fName, err)
+	}
+	defer f.Close()
+	buf := make([]byte, ptr.valsz)
+	if _, err = f.ReadAt(buf, ptr.valops); err != nil {
+		return nil, fmt.Errorf("read blob file: %s error: %v", ptr.fName, err)
+	}
+	return buf, nil
+}
+
+// readBlobPtr 读取KindBlob索引项指向的段文件记录中的blob指针
+func (engine *DBEngine) readBlobPtr(index MemIdxV) (blobPtr, error) {
+	segF, err := os.OpenFile(path.Join(engine.dataDir, index.fName), os.O_RDONLY, FileMode)
+	if err != nil {
+		return blobPtr{}, fmt.Errorf("open file: %s error: %v", index.fName, err)
+	}
+	defer segF.Close()
+	buf := make([]byte, index.valsz)
+	if _, err = segF.ReadAt(buf, index.valops); err != nil {
+		return blobPtr{}, fmt.Errorf("read file: %s error: %v", index.fName, err)
+	}
+	return decodeBlobPtr(string(buf))
+}
+
+// refsBlob 判断索引项是否引用blob文件blobFName中的记录：头部带有序列号的记录比较序列号，流式写入的记录比较指针位置
+func (engine *DBEngine) refsBlob(index MemIdxV, blobFName string, seg *Segment) bool {
+	if index.kind != KindBlob {
+		return false
+	}
+	if seg.seq != 0 {
+		return index.seq == seg.seq
+	}
+	ptr, err := engine.readBlobPtr(index)
+	return err == nil && ptr.fName == blobFName && ptr.valops == seg.valops
+}
+
+// isLiveBlob 判断blob文件blobFName中的记录是否仍被内存索引引用
+func (engine *DBEngine) isLiveBlob(blobFName string, seg *Segment) bool {
+	idx, ok := engine.getMemIdx(seg.key)
+	return ok && engine.refsBlob(idx, blobFName, seg)
+}
+
+// scanBlobF 顺序扫描blob文件，对每条记录(key已解密，valops为value在blob文件中的位置)调用fn；遇到残缺记录(写入中断导致)时停止扫描
+func (engine *DBEngine) scanBlobF(blobFName string, fn func(seg *Segment, n int) error) error {
+	f, reader, err := openDataF(path.Join(engine.dataDir, blobFName), BlobFMagic)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset := int64(FHeaderSize)
+	for {
+		seg, n, err := readBlob(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			slogger.Errorf("blob file: %s broken record, discard the rest: %v", blobFName, err)
+			return nil
+		}
+		seg.valops = offset + int64(n-NewLineSize-seg.valsz)
+		offset += int64(n)
+		if seg.key, err = engine.crypt.openKey(seg.keyID, seg.key); err != nil {
+			return err
+		}
+		if err = fn(seg, n); err != nil {
+			return err
+		}
+	}
+}
+
+// blobGC blob文件垃圾回收：对于失效数据占比达到BlobGCRatio的冻结blob文件，将其中仍有效的value重新写入活跃blob文件，
+// 并在段文件中写入新的指针记录，然后删除原blob文件(仍被快照引用时延迟删除)；回收过程中使用旧密钥加密的value使用当前密钥重新加密
+// 指针记录与段合并复制的记录一样保留原记录的序列号，重建索引时序列号相同的记录以较新的段文件中的记录为准
+func (engine *DBEngine) blobGC() {
+	engine.segMergeMu.Lock() // 与段合并互斥，引擎关闭后不再进行垃圾回收
+	defer engine.segMergeMu.Unlock()
+	if engine.closed.Load() {
+		return
+	}
+	engine.segFMu.Lock()
+	activeFName := engine.blobFName
+	engine.segFMu.Unlock()
+	dels := make([]string, 0)
+	cdcFs := engine.cdcBlobFs()
+	for _, blobFName := range engine.manifest.liveFs(BlobFNamePrefix) {
+		// 仍有消费者未确认的变化引用的blob文件不进行回收
+		if blobFName == activeFName || cdcFs[blobFName] {
+			continue
+		}
+		// 1. 统计blob文件中有效数据的占比
+		var total, live int
+		retained := false
+		err := engine.scanBlobF(blobFName, func(seg *Segment, n int) error {
+			total += n
+			if engine.isLiveBlob(blobFName, seg) {
+				live += n
+			} else if engine.isRetainedBlob(blobFName, seg) {
+				retained = true
+			}
+			return nil
+		})
+		if err != nil {
+			slogger.Errorf("scan blob file: %s error: %v", blobFName, err)
+			continue
+		}
+		// 仍被历史版本引用的blob文件不进行回收
+		if retained || total > 0 && float64(total-live) < BlobGCRatio*float64(total) {
+			continue
+		}
+		// 2. 将有效的value重新写入
+		err = engine.scanBlobF(blobFName, func(seg *Segment, _ int) error {
+			return engine.moveBlob(blobFName, seg)
+		})
+		if err != nil {
+			slogger.Errorf("move blob file: %s error: %v", blobFName, err)
+			continue
+		}
+		dels = append(dels, blobFName)
+	}
+	if len(dels) == 0 {
+		return
+	}
+	// 3. 新的数据刷盘后，将回收结果记录到MANIFEST，然后删除原blob文件
+	engine.segFMu.Lock()
+	for _, fName := range []string{engine.segFName, engine.blobFName} {
+		if fName == "" {
+			continue
+		}
+		if err := syncF(path.Join(engine.dataDir, fName)); err != nil {
+			slogger.Errorf("sync file: %s error: %v", fName, err)
+		}
+	}
+	engine.segFMu.Unlock()
+	if err := engine.manifest.commit(nil, dels); err != nil {
+		slogger.Fatalf("record blob gc result to manifest error: %v", err)
+	}
+	engine.removeDataFs(dels)
+	slogger.Infof("blob gc done! blob files: %v\n", dels)
+}
+
+// moveBlob 若blob记录仍有效，将value写入活跃blob文件，并在段文件中写入指向新位置的指针记录(带有FlagMoved标记)，然后更新索引
+// 指针记录保留原记录的序列号和时间戳，不是新的写入：不通知订阅者，CDC不返回，事务的冲突检测和key的版本号不受影响
+func (engine *DBEngine) moveBlob(blobFName string, seg *Segment) error {
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	idx, ok := engine.getMemIdx(seg.key)
+	if !ok || !engine.refsBlob(idx, blobFName, seg) {
+		return nil
+	}
+	value, keyID, err := engine.resealVal(seg.key, seg.value, seg.codec, seg.keyID)
+	if err != nil {
+		return err
+	}
+	seg.value, seg.keyID, seg.seq, seg.tm = value, keyID, idx.seq, idx.tm
+	seg.keysz = len(seg.key)
+	ptr, err := engine.writeBlob(seg)
+	if err != nil {
+		return err
+	}
+	seg.kind, seg.value, seg.valsz = KindBlob|FlagMoved, ptr, len(ptr)
+	return engine.appendSegLocked(seg)
+}
+
+// syncF 将文件刷新到磁盘
+func syncF(fPath string) error {
+	f, err := os.OpenFile(fPath, os.O_RDONLY, FileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,281 @@
+package xdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 桶：同一个数据库中相互独立的key空间，桶中的key在引擎内部保存为：BucketKeyPrefix+桶名称+BucketKeyPrefix+key
+// DropBucket 只写入一条删除桶记录(KindDropBucket，key为桶的内部前缀)，序列号小于该记录的桶中的key全部失效；
+// 写入后立即从内存索引中清除已删除桶中的key，引擎启动时读到删除桶记录同样清除，清除之后删除桶记录不再保留在内存索引中
+
+// DBBucket 桶，通过Bucket获取
+type DBBucket struct {
+	name   string // 桶名称
+	prefix string // 桶中key的内部前缀
+}
+
+// BucketStats 桶的统计信息
+type BucketStats struct {
+	Keys  int   // 有效key数量
+	Bytes int64 // 有效value(压缩、加密后)的总长度
+}
+
+// Bucket 获取名称为name的桶，桶在首次写入时创建
+func Bucket(name string) (*DBBucket, error) {
+	// 以控制字符开头的名称保留给引擎内部使用(二级索引、CDC等)
+	if name == "" || strings.Contains(name, BucketKeyPrefix) || name[0] < ' ' {
+		return nil, fmt.Errorf("bad bucket name: %q", name)
+	}
+	return &DBBucket{name: name, prefix: bucketPrefix(name)}, nil
+}
+
+// bucketPrefix 获取桶中key的内部前缀
+func bucketPrefix(name string) string {
+	return BucketKeyPrefix + name + BucketKeyPrefix
+}
+
+// isInternalKey 判断是否为引擎内部使用的key(桶中的key、删除桶记录等)
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, BucketKeyPrefix)
+}
+
+// keyGroup 获取内部key所属的分组前缀：桶中的key按桶分组(bucketPrefix)，二级索引项按索引词分组(indexTermPrefix)，CDC消费者为一个分组；
+// 删除桶记录等其他内部key不属于任何分组
+func keyGroup(key string) (string, bool) {
+	if !isInternalKey(key) || len(key) < len(BucketKeyPrefix)+1 {
+		return "", false
+	}
+	if strings.HasPrefix(key, CDCConsumerPrefix) {
+		return CDCConsumerPrefix, len(key) > len(CDCConsumerPrefix)
+	}
+	n, seps := len(BucketKeyPrefix), 1
+	switch {
+	case strings.HasPrefix(key, IndexKeyPrefix):
+		n, seps = len(IndexKeyPrefix), 2
+	case key[len(BucketKeyPrefix)] < ' ':
+		return "", false
+	}
+	for i := 0; i < seps; i++ {
+		end := strings.Index(key[n:], BucketKeyPrefix)
+		if end < 0 {
+			return "", false
+		}
+		n += end + len(BucketKeyPrefix)
+	}
+	if n == len(key) {
+		return "", false
+	}
+	return key[:n], true
+}
+
+// splitBucketKey 从桶中key或删除桶记录key的内部表示中解析桶名称和key(删除桶记录为空)，不是桶中的key时返回false
+func splitBucketKey(key string) (string, string, bool) {
+	n := len(BucketKeyPrefix)
+	if !isInternalKey(key) || len(key) <= n || key[n] < ' ' {
+		return "", "", false
+	}
+	end := strings.Index(key[n:], BucketKeyPrefix)
+	if end < 0 {
+		return "", "", false
+	}
+	return key[n : n+end], key[n+end+len(BucketKeyPrefix):], true
+}
+
+// checkUserKey 检查调用方直接写入的key：以BucketKeyPrefix开头的key保留给引擎内部使用(桶、二级索引、CDC等)，ReservedPrefix返回的前缀范围除外
+func checkUserKey(key string) error {
+	if isInternalKey(key) && !strings.HasPrefix(key, ReservedKeyPrefix) {
+		return fmt.Errorf("idxK: %q is reserved for internal use", key)
+	}
+	return nil
+}
+
+// ReservedPrefix 返回保留给调用方使用的内部key前缀：ReservedKeyPrefix+name+BucketKeyPrefix
+// 以该前缀开头的key可以通过Put、Remove、事务等读写，与桶中的key一样不属于顶层key(ListKey、Watch、CDC不返回)
+func ReservedPrefix(name string) (string, error) {
+	if name == "" || strings.Contains(name, BucketKeyPrefix) {
+		return "", fmt.Errorf("bad reserved prefix name: %q", name)
+	}
+	return ReservedKeyPrefix + name + BucketKeyPrefix, nil
+}
+
+// Name 返回桶名称
+func (b *DBBucket) Name() string {
+	return b.name
+}
+
+// Put 将(key,value)保存到桶中
+func (b *DBBucket) Put(key, value string) error {
+	if key == "" || value == "" {
+		return fmt.Errorf("idxK, value can not be empty, idxK: %s, value: %s", key, value)
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	if idxs := dbEngine.indexesOf(b.name); len(idxs) > 0 {
+		return dbEngine.indexedWrite(b, idxs, key, &value)
+	}
+	return dbEngine.putInternal(b.prefix+key, value)
+}
+
+// Query 从桶中查找key对应的value
+func (b *DBBucket) Query(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("%s", "idxK can not be empty")
+	}
+	return Query(b.prefix + key)
+}
+
+// Remove 从桶中删除key
+func (b *DBBucket) Remove(key string) error {
+	if key == "" {
+		return fmt.Errorf("idxK, value can not be empty, idxK: %s", key)
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	if idxs := dbEngine.indexesOf(b.name); len(idxs) > 0 {
+		return dbEngine.indexedWrite(b, idxs, key, nil)
+	}
+	return dbEngine.removeInternal(b.prefix + key)
+}
+
+// ListKey 按字典序返回桶中所有有效的key，数据库未打开或已关闭时返回空列表；只读取内存中该桶的key集合，不遍历全部key
+func (b *DBBucket) ListKey() []string {
+	if dbEngine.checkOpen() != nil {
+		return make([]string, 0)
+	}
+	return dbEngine.groupKeys(b.prefix)
+}
+
+// ForEach 按key的字典序遍历桶中的键值对，fn返回false时停止遍历；遍历期间删除的key被跳过
+func (b *DBBucket) ForEach(fn func(key, value string) bool) error {
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	for _, key := range b.ListKey() {
+		indexValue, ok := dbEngine.getMemIdx(b.prefix + key)
+		if !ok {
+			continue
+		}
+		value, err := dbEngine.seekKey(b.prefix+key, indexValue)
+		if err != nil {
+			return fmt.Errorf("idxK: %s, read value error: %v", key, err)
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Stats 返回桶的统计信息，数据库未打开或已关闭时返回空的统计信息
+func (b *DBBucket) Stats() BucketStats {
+	stats := BucketStats{}
+	if dbEngine.checkOpen() != nil {
+		return stats
+	}
+	dbEngine.memIdxMu.RLock()
+	defer dbEngine.memIdxMu.RUnlock()
+	for k := range dbEngine.keySets[b.prefix] {
+		stats.Keys++
+		stats.Bytes += int64(dbEngine.memIdx[k].valsz)
+	}
+	return stats
+}
+
+// DropBucket 删除桶中的全部key，只写入一条删除桶记录；桶上注册的二级索引同时清空
+func DropBucket(name string) error {
+	b, err := Bucket(name)
+	if err != nil {
+		return err
+	}
+	if err = dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	prefixes := []string{b.prefix}
+	for _, idx := range dbEngine.indexesOf(name) {
+		prefixes = append(prefixes, indexPrefix(idx.name))
+	}
+	return dbEngine.dropPrefixes(prefixes, nil)
+}
+
+// dropPrefixes 通过一个批量写入为每个内部前缀写入删除桶记录，并删除dels中的key，然后清除失效的key
+func (engine *DBEngine) dropPrefixes(prefixes, dels []string) error {
+	keyID, err := engine.crypt.currentKeyID()
+	if err != nil {
+		return err
+	}
+	tm := time.Now().UnixNano()
+	segs := make([]*Segment, 0, len(prefixes)+len(dels))
+	for _, prefix := range prefixes {
+		segs = append(segs, &Segment{
+			value: DropBucketValue,
+			Hint: Hint{
+				key:   prefix,
+				keysz: len(prefix),
+				val:   val{tm: tm, kind: KindDropBucket, valsz: len(DropBucketValue), keyID: keyID},
+			},
+		})
+	}
+	for _, key := range dels {
+		segs = append(segs, &Segment{Hint: Hint{key: key, keysz: len(key), val: val{tm: tm, keyID: keyID}}})
+	}
+	// 持有段文件锁，保证删除桶记录之前的写入全部被清除，之后的写入全部保留
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	if err = engine.writeBatchLocked(segs); err != nil {
+		if errors.Is(err, ErrClosed) {
+			return err
+		}
+		slogger.Fatalf("write seg to file: %s error: %v", engine.segFName, err)
+	}
+	drops := make(map[string]uint64, len(prefixes))
+	for _, seg := range segs[:len(prefixes)] {
+		drops[seg.key] = seg.seq
+	}
+	engine.purgeDropped(drops)
+	return nil
+}
+
+// purgeDropped 从内存索引和历史版本中清除已删除桶(drops：内部前缀->删除桶记录的序列号)中序列号小于删除桶记录的key，只遍历以内部前缀开头的分组key集合；
+// 清除完成后删除桶记录不再保留在内存索引中：段合并不再复制该记录，只有在比其更早的段文件全部被合并之后，所在的段文件才会被合并，
+// 因此重建索引时读到的被删除的key一定同时读到删除桶记录
+func (engine *DBEngine) purgeDropped(drops map[string]uint64) {
+	if len(drops) == 0 {
+		return
+	}
+	engine.memIdxMu.Lock()
+	defer engine.memIdxMu.Unlock()
+	for prefix, dropSeq := range drops {
+		// 二级索引的索引项按索引词分组，一个内部前缀可能对应多个分组
+		for group, keys := range engine.keySets {
+			if !strings.HasPrefix(group, prefix) {
+				continue
+			}
+			for k := range keys {
+				if engine.memIdx[k].seq < dropSeq {
+					engine.delMemIdx(k)
+				}
+			}
+		}
+		if v, ok := engine.memIdx[prefix]; ok && v.kind == KindDropBucket && v.seq == dropSeq {
+			engine.delMemIdx(prefix)
+		}
+		// 启用保留策略时，清除历史版本
+		for k, vers := range engine.versions {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			kept := make([]MemIdxV, 0, len(vers))
+			for _, v := range vers {
+				if v.seq >= dropSeq {
+					kept = append(kept, v)
+				}
+			}
+			engine.setVersions(k, kept)
+		}
+	}
+}
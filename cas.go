@@ -0,0 +1,86 @@
+package xdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CompareAndSwap 当key当前的value等于old时，将value更新为new；返回是否更新成功
+func CompareAndSwap(key, old, new string) (bool, error) {
+	if key == "" || old == "" || new == "" {
+		return false, fmt.Errorf("idxK, old, new can not be empty, idxK: %s, old: %s, new: %s", key, old, new)
+	}
+	return dbEngine.condWrite(key, &new, func(cur string, ok bool) bool {
+		return ok && cur == old
+	})
+}
+
+// PutIfAbsent 当key不存在时写入(key,value)；返回是否写入成功
+func PutIfAbsent(key, value string) (bool, error) {
+	if key == "" || value == "" {
+		return false, fmt.Errorf("idxK, value can not be empty, idxK: %s, value: %s", key, value)
+	}
+	return dbEngine.condWrite(key, &value, func(_ string, ok bool) bool {
+		return !ok
+	})
+}
+
+// DeleteIfEquals 当key当前的value等于value时删除key；返回是否删除成功
+func DeleteIfEquals(key, value string) (bool, error) {
+	if key == "" || value == "" {
+		return false, fmt.Errorf("idxK, value can not be empty, idxK: %s, value: %s", key, value)
+	}
+	return dbEngine.condWrite(key, nil, func(cur string, ok bool) bool {
+		return ok && cur == value
+	})
+}
+
+// condWrite 持有段文件锁读取key当前的value，满足条件cond时写入value(value为nil表示删除)；
+// 检查与写入之间其他写入无法获取段文件锁，保证条件写入的原子性
+func (engine *DBEngine) condWrite(key string, value *string, cond func(cur string, ok bool) bool) (bool, error) {
+	if err := checkUserKey(key); err != nil {
+		return false, err
+	}
+	if err := engine.checkOpen(); err != nil {
+		return false, err
+	}
+	keyID, err := engine.crypt.currentKeyID()
+	if err != nil {
+		return false, err
+	}
+	seg := &Segment{
+		Hint: Hint{
+			key:   key,
+			keysz: len(key),
+			val:   val{tm: time.Now().UnixNano(), keyID: keyID},
+		},
+	}
+	// 在锁外完成value的压缩、加密
+	if value != nil {
+		stored, codecID, valKeyID, err := engine.encodeVal(key, *value)
+		if err != nil {
+			return false, err
+		}
+		seg.value, seg.valsz, seg.codec, seg.keyID = stored, len(stored), codecID, valKeyID
+	}
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	var cur string
+	indexValue, ok := engine.getMemIdx(key)
+	if ok {
+		if cur, err = engine.seekKey(key, indexValue); err != nil {
+			return false, fmt.Errorf("idxK: %s, read value error: %v", key, err)
+		}
+	}
+	if !cond(cur, ok) {
+		return false, nil
+	}
+	if err = engine.appendSegLocked(seg); err != nil {
+		if errors.Is(err, ErrClosed) {
+			return false, err
+		}
+		slogger.Fatalf("write seg to file: %s error: %v", engine.segFName, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,286 @@
+package xdb
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// 变更数据捕获(CDC)：ChangesSince 按写入顺序从段文件中读取序列号大于指定值的记录，读取期间引用的段文件不会被删除
+// 段合并会丢弃被覆盖的记录，MANIFEST记录被合并的记录中的最大序列号，更早的变化无法读取时返回ErrChangesCompacted；
+// 持久化的消费者(OpenConsumer)记录已确认的序列号，段合并只合并其中全部记录都已被所有消费者确认的段文件(根据MANIFEST中记录的段文件最大序列号判断)
+// 变化中包含顶层key和桶中的key(Event.Bucket为桶名称)的写入/删除以及删除桶，不包含二级索引、CDC消费者等内部key；
+// value 保存在blob文件中的记录从blob文件读取value，消费者尚未确认的变化引用的blob文件不会被垃圾回收，
+// 不通过消费者读取时，已被覆盖的value所在的blob文件可能已被回收，此时value为空
+
+// ChangeIter 变化迭代器，使用完毕后需要调用Close
+type ChangeIter struct {
+	engine  *DBEngine
+	seq     uint64      // 只返回序列号大于seq的记录
+	segFs   []string    // 尚未读取的段文件，按创建时间升序排列
+	pin     *DBSnapshot // 阻止读取期间段文件被删除
+	changes []Event     // 当前段文件中尚未返回的变化
+	cur     Event       // 当前变化
+	err     error
+}
+
+// ChangesSince 返回读取序列号大于seq的变化的迭代器；seq 之后的部分变化已被段合并丢弃时返回ErrChangesCompacted
+func ChangesSince(seq uint64) (*ChangeIter, error) {
+	engine := dbEngine
+	if err := engine.checkOpen(); err != nil {
+		return nil, err
+	}
+	pin := engine.pinFs()
+	if floor := engine.cdcFloor(); seq < floor {
+		pin.Release()
+		return nil, fmt.Errorf("%w: seq: %d, compacted seq: %d", ErrChangesCompacted, seq, floor)
+	}
+	segFs := engine.manifest.liveFs(SegFNamePrefix)
+	for i, j := 0, len(segFs)-1; i < j; i, j = i+1, j-1 {
+		segFs[i], segFs[j] = segFs[j], segFs[i]
+	}
+	return &ChangeIter{engine: engine, seq: seq, segFs: segFs, pin: pin}, nil
+}
+
+// Next 读取下一个变化，没有更多变化或出错时返回false
+func (it *ChangeIter) Next() bool {
+	for len(it.changes) == 0 {
+		if it.err != nil || len(it.segFs) == 0 {
+			return false
+		}
+		it.changes, it.err = it.engine.segChanges(it.segFs[0], it.seq)
+		it.segFs = it.segFs[1:]
+	}
+	it.cur, it.changes = it.changes[0], it.changes[1:]
+	return true
+}
+
+// Change 返回当前变化
+func (it *ChangeIter) Change() Event {
+	return it.cur
+}
+
+// Err 返回迭代过程中的错误
+func (it *ChangeIter) Err() error {
+	return it.err
+}
+
+// Close 关闭迭代器，释放引用的段文件
+func (it *ChangeIter) Close() {
+	it.pin.Release()
+}
+
+// segChanges 读取段文件中序列号大于seq的顶层key和桶中的key的变化
+func (engine *DBEngine) segChanges(segFName string, seq uint64) ([]Event, error) {
+	f, reader, err := openDataF(path.Join(engine.dataDir, segFName), SegFMagic)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	changes := make([]Event, 0)
+	_, err = engine.scanSegF(reader, FHeaderSize, func(seg *Segment) error {
+		// blob文件垃圾回收迁移value后写入的指针记录不是新的变化
+		if seg.seq <= seq || seg.kind&FlagMoved != 0 {
+			return nil
+		}
+		change := Event{Type: EventPut, Key: seg.key, Seq: seg.seq}
+		if isInternalKey(seg.key) {
+			bucket, key, ok := splitBucketKey(seg.key)
+			if !ok {
+				return nil // 二级索引、CDC消费者等内部key
+			}
+			change.Bucket, change.Key = bucket, key
+		}
+		var err error
+		switch {
+		case seg.kind == KindDropBucket:
+			change.Type = EventDropBucket
+		case seg.valsz == 0:
+			change.Type = EventDelete
+		case seg.kind == KindVal:
+			change.Value, err = engine.decodeVal(seg.key, []byte(seg.value), seg.codec, seg.keyID)
+		case seg.kind == KindMerge:
+			change.Value, err = engine.seekKey(seg.key, segment2MemIndex(seg, segFName).idxV)
+		case seg.kind == KindBlob:
+			change.Value, err = engine.seekKey(seg.key, segment2MemIndex(seg, segFName).idxV)
+			// 原blob文件已被垃圾回收时，仍有效的value从迁移后的位置读取
+			if idx, ok := engine.getMemIdx(seg.key); err != nil && ok && idx.seq == seg.seq {
+				change.Value, err = engine.seekKey(seg.key, idx)
+			}
+			if err != nil {
+				slogger.Warnf("idxK: %s, seq: %d, read blob value error: %v", seg.key, seg.seq, err)
+				change.Value, err = "", nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("idxK: %s, read value error: %v", seg.key, err)
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read segment file: %s changes error: %v", segFName, err)
+	}
+	return changes, nil
+}
+
+// pinFs 创建一个不复制内存索引的快照，阻止当前的数据文件被删除
+func (engine *DBEngine) pinFs() *DBSnapshot {
+	engine.snapMu.Lock()
+	defer engine.snapMu.Unlock()
+	engine.snapGen++
+	snap := &DBSnapshot{engine: engine, gen: engine.snapGen}
+	engine.snaps[snap.gen] = snap
+	return snap
+}
+
+// readSeqKey 读取以十进制保存序列号的内部key，key不存在时返回0
+func (engine *DBEngine) readSeqKey(key string) (uint64, error) {
+	indexValue, ok := engine.getMemIdx(key)
+	if !ok {
+		return 0, nil
+	}
+	value, err := engine.seekKey(key, indexValue)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// cdcFloor 获取已被段合并丢弃的记录中的最大序列号
+func (engine *DBEngine) cdcFloor() uint64 {
+	return engine.manifest.cdcFloor()
+}
+
+// Consumer 持久化的CDC消费者，记录已确认的序列号，重启后从该序列号之后继续读取
+type Consumer struct {
+	engine *DBEngine
+	name   string
+	key    string // 保存已确认序列号的内部key
+}
+
+// OpenConsumer 打开名称为name的消费者；消费者不存在时创建，从当前序列号之后开始读取
+func OpenConsumer(name string) (*Consumer, error) {
+	if name == "" {
+		return nil, fmt.Errorf("bad consumer name: %q", name)
+	}
+	engine := dbEngine
+	if err := engine.checkOpen(); err != nil {
+		return nil, err
+	}
+	c := &Consumer{engine: engine, name: name, key: CDCConsumerPrefix + name}
+	engine.segFMu.Lock()
+	seq := engine.seq
+	engine.segFMu.Unlock()
+	if _, ok := engine.getMemIdx(c.key); !ok {
+		if err := c.Ack(seq); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Seq 返回消费者已确认的序列号
+func (c *Consumer) Seq() (uint64, error) {
+	if err := c.engine.checkOpen(); err != nil {
+		return 0, err
+	}
+	return c.engine.readSeqKey(c.key)
+}
+
+// Changes 返回读取已确认的序列号之后的变化的迭代器
+func (c *Consumer) Changes() (*ChangeIter, error) {
+	seq, err := c.Seq()
+	if err != nil {
+		return nil, err
+	}
+	return ChangesSince(seq)
+}
+
+// Ack 确认序列号不大于seq的变化已处理，之后段合并可以丢弃这些变化
+func (c *Consumer) Ack(seq uint64) error {
+	return c.engine.putInternal(c.key, strconv.FormatUint(seq, 10))
+}
+
+// RemoveConsumer 删除消费者，不再为其保留段文件
+func RemoveConsumer(name string) error {
+	if name == "" {
+		return fmt.Errorf("bad consumer name: %q", name)
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	return dbEngine.removeInternal(CDCConsumerPrefix + name)
+}
+
+// minConsumerSeq 获取全部消费者已确认的序列号中的最小值，不存在消费者时返回false
+func (engine *DBEngine) minConsumerSeq() (uint64, bool) {
+	keys := engine.groupKeys(CDCConsumerPrefix)
+	var minSeq uint64
+	for i, name := range keys {
+		key := CDCConsumerPrefix + name
+		seq, err := engine.readSeqKey(key)
+		if err != nil {
+			slogger.Errorf("read consumer: %s seq error: %v", key, err)
+			seq = 0
+		}
+		if i == 0 || seq < minSeq {
+			minSeq = seq
+		}
+	}
+	return minSeq, len(keys) > 0
+}
+
+// segMaxSeq 获取段文件中记录的最大序列号：优先使用MANIFEST中的记录，没有记录时(尚未生成hint文件)扫描段文件
+func (engine *DBEngine) segMaxSeq(segFName string) uint64 {
+	if seq, ok := engine.manifest.maxSeq(segFName); ok {
+		return seq
+	}
+	return engine.loadSegIdx(segFName).maxSeq()
+}
+
+// consumedSegFs 从最早的段文件开始，返回全部记录都已被所有消费者确认的段文件，遇到尚未确认的段文件时停止，按时间戳倒序排列；
+// 只合并最早的连续段文件，保证序列号相同的记录(blob文件垃圾回收迁移的记录)不会出现在比原记录更早的段文件中
+func (engine *DBEngine) consumedSegFs(segFs []string) []string {
+	minSeq, ok := engine.minConsumerSeq()
+	if !ok {
+		return segFs
+	}
+	n := len(segFs)
+	for n > 0 && engine.segMaxSeq(segFs[n-1]) <= minSeq {
+		n--
+	}
+	return segFs[n:]
+}
+
+// cdcBlobFs 获取序列号大于全部消费者已确认的序列号的blob指针记录引用的blob文件，blob文件垃圾回收保留这些文件，保证消费者可以读取变化的value
+func (engine *DBEngine) cdcBlobFs() map[string]bool {
+	blobFs := make(map[string]bool)
+	minSeq, ok := engine.minConsumerSeq()
+	if !ok {
+		return blobFs
+	}
+	for _, segFName := range engine.manifest.liveFs(SegFNamePrefix) {
+		if seq, ok := engine.manifest.maxSeq(segFName); ok && seq <= minSeq {
+			continue
+		}
+		f, reader, err := openDataF(path.Join(engine.dataDir, segFName), SegFMagic)
+		if err != nil {
+			slogger.Errorf("open segment file: %s error: %v", segFName, err)
+			continue
+		}
+		_, err = engine.scanSegF(reader, FHeaderSize, func(seg *Segment) error {
+			if seg.seq > minSeq && seg.kind == KindBlob {
+				if ptr, err := decodeBlobPtr(seg.value); err == nil {
+					blobFs[ptr.fName] = true
+				}
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			slogger.Errorf("scan segment file: %s error: %v", segFName, err)
+		}
+	}
+	return blobFs
+}
@@ -0,0 +1,20 @@
+// xdb-migrate 将数据目录下旧格式的段文件和hint文件离线迁移为当前格式
+//
+// 用法：xdb-migrate -dir /path/to/data
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/CatchTheDog/xdb"
+)
+
+func main() {
+	dataDir := flag.String("dir", xdb.DataDir, "数据文件保存目录")
+	flag.Parse()
+	if err := xdb.Migrate(*dataDir); err != nil {
+		log.Fatalf("migrate data dir: %s error: %v", *dataDir, err)
+	}
+	log.Printf("migrate data dir: %s done, format version: %d", *dataDir, xdb.FormatVersion)
+}
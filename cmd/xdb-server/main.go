@@ -0,0 +1,62 @@
+// xdb-server 打开数据目录并通过HTTP(以及可选的Redis RESP协议、memcached文本协议)对外提供键值接口，
+// 收到SIGINT/SIGTERM后等待正在处理的请求完成并关闭数据库
+//
+// 用法：xdb-server -dir /path/to/data -addr :8088 -resp :6379 -memcache :11211
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/CatchTheDog/xdb"
+	"github.com/CatchTheDog/xdb/server"
+)
+
+func main() {
+	dataDir := flag.String("dir", xdb.DataDir, "数据文件保存目录")
+	addr := flag.String("addr", fmt.Sprintf(":%d", xdb.HTTPPort), "HTTP监听地址")
+	respAddr := flag.String("resp", "", "Redis RESP协议监听地址，为空时不启动")
+	memcacheAddr := flag.String("memcache", "", "memcached文本协议监听地址，为空时不启动")
+	timeout := flag.Duration("shutdown-timeout", 10*time.Second, "关闭时等待正在处理的请求完成的最长时间")
+	flag.Parse()
+	if err := xdb.Open(*dataDir); err != nil {
+		log.Fatalf("open data dir: %s error: %v", *dataDir, err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srvs := []server.Server{server.NewHTTPServer(*addr)}
+	if *respAddr != "" {
+		srvs = append(srvs, server.NewRESPServer(*respAddr))
+	}
+	if *memcacheAddr != "" {
+		srvs = append(srvs, server.NewMemcacheServer(*memcacheAddr))
+	}
+	errCh := make(chan error, len(srvs))
+	for _, srv := range srvs {
+		go func(srv server.Server) {
+			errCh <- srv.ListenAndServe()
+		}(srv)
+	}
+	log.Printf("xdb-server listening on http: %s, resp: %s, memcache: %s, data dir: %s", *addr, *respAddr, *memcacheAddr, *dataDir)
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("serve error: %v", err)
+		}
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx, srvs...); err != nil {
+		log.Fatalf("shutdown error: %v", err)
+	}
+	log.Printf("xdb-server stopped")
+}
@@ -0,0 +1,208 @@
+package xdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Codec 数据压缩编解码器；编解码器标识写入每条记录的头部，读取时据此选择编解码器解压
+type Codec interface {
+	ID() uint8                         // 编解码器标识，0 保留给不压缩的NoneCodec
+	Encode(src []byte) ([]byte, error) // 压缩
+	Decode(src []byte) ([]byte, error) // 解压
+}
+
+var (
+	NoneCodec  Codec = noneCodec{}  // 不压缩
+	FlateCodec Codec = flateCodec{} // DEFLATE 压缩
+	GzipCodec  Codec = gzipCodec{}  // gzip 压缩
+)
+
+var (
+	codecs = map[uint8]Codec{ // 已注册的编解码器
+		NoneCodec.ID():  NoneCodec,
+		FlateCodec.ID(): FlateCodec,
+		GzipCodec.ID():  GzipCodec,
+	}
+	codecsMu sync.RWMutex // 编解码器注册表锁
+)
+
+// RegisterCodec 注册自定义编解码器，编解码器标识不能与已注册的编解码器重复
+func RegisterCodec(codec Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[codec.ID()]; ok {
+		return fmt.Errorf("codec id: %d already registered", codec.ID())
+	}
+	codecs[codec.ID()] = codec
+	return nil
+}
+
+// useCodec 检查引擎使用的编解码器：标识未注册时注册，标识已被其他编解码器(类型不同)注册时返回错误，避免使用内置编解码器的标识的自定义编解码器被忽略
+func useCodec(codec Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	registered, ok := codecs[codec.ID()]
+	if !ok {
+		codecs[codec.ID()] = codec
+		return nil
+	}
+	if reflect.TypeOf(registered) != reflect.TypeOf(codec) {
+		return fmt.Errorf("codec id: %d already registered by %T", codec.ID(), registered)
+	}
+	return nil
+}
+
+// getCodec 获取编解码器标识对应的编解码器
+func getCodec(id uint8) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec id: %d", id)
+	}
+	return codec, nil
+}
+
+// encodeVal 按照引擎配置压缩、加密value：value长度小于压缩阈值，或压缩后没有变小时，不压缩
+// 段文件为文本格式，压缩或加密后的数据使用base64编码存储；加密时使用value所属的key作为附加数据；返回存储的value、编解码器标识及密钥标识
+func (engine *DBEngine) encodeVal(key, value string) (string, uint8, uint32, error) {
+	data, codecID := []byte(value), NoneCodec.ID()
+	if engine.codec.ID() != NoneCodec.ID() && len(value) >= engine.compressThreshold {
+		compressed, err := engine.codec.Encode(data)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("codec: %d encode error: %v", engine.codec.ID(), err)
+		}
+		if base64.RawStdEncoding.EncodedLen(len(compressed)) < len(value) {
+			data, codecID = compressed, engine.codec.ID()
+		}
+	}
+	keyID, err := engine.crypt.currentKeyID()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if keyID != 0 {
+		if data, err = engine.crypt.sealVal(keyID, key, data); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	if codecID == NoneCodec.ID() && keyID == 0 {
+		return value, codecID, keyID, nil
+	}
+	return base64.RawStdEncoding.EncodeToString(data), codecID, keyID, nil
+}
+
+// decodeVal 将key的存储的value解密、解压为原始value
+func (engine *DBEngine) decodeVal(key string, stored []byte, codecID uint8, keyID uint32) (string, error) {
+	if codecID == NoneCodec.ID() && keyID == 0 {
+		return string(stored), nil
+	}
+	data := make([]byte, base64.RawStdEncoding.DecodedLen(len(stored)))
+	n, err := base64.RawStdEncoding.Decode(data, stored)
+	if err != nil {
+		return "", fmt.Errorf("base64 decode value error: %v", err)
+	}
+	data = data[:n]
+	if keyID != 0 {
+		if data, err = engine.crypt.openVal(keyID, key, data); err != nil {
+			return "", err
+		}
+	}
+	codec, err := getCodec(codecID)
+	if err != nil {
+		return "", err
+	}
+	value, err := codec.Decode(data)
+	if err != nil {
+		return "", fmt.Errorf("codec: %d decode error: %v", codecID, err)
+	}
+	return string(value), nil
+}
+
+// resealVal 使用当前密钥重新加密key的value(段合并时使用)，返回新的存储value及密钥标识
+func (engine *DBEngine) resealVal(key, stored string, codecID uint8, keyID uint32) (string, uint32, error) {
+	curKeyID, err := engine.crypt.currentKeyID()
+	if err != nil || curKeyID == keyID {
+		return stored, keyID, err
+	}
+	data := []byte(stored)
+	if codecID != NoneCodec.ID() || keyID != 0 {
+		if data, err = base64.RawStdEncoding.DecodeString(stored); err != nil {
+			return "", 0, fmt.Errorf("base64 decode value error: %v", err)
+		}
+	}
+	if keyID != 0 {
+		if data, err = engine.crypt.openVal(keyID, key, data); err != nil {
+			return "", 0, err
+		}
+	}
+	if data, err = engine.crypt.sealVal(curKeyID, key, data); err != nil {
+		return "", 0, err
+	}
+	return base64.RawStdEncoding.EncodeToString(data), curKeyID, nil
+}
+
+// noneCodec 不压缩
+type noneCodec struct{}
+
+func (noneCodec) ID() uint8                         { return 0 }
+func (noneCodec) Encode(src []byte) ([]byte, error) { return src, nil }
+func (noneCodec) Decode(src []byte) ([]byte, error) { return src, nil }
+
+// flateCodec DEFLATE 压缩
+type flateCodec struct{}
+
+func (flateCodec) ID() uint8 { return 1 }
+
+func (flateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(src); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// gzipCodec gzip 压缩
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8 { return 2 }
+
+func (gzipCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
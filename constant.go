@@ -3,24 +3,81 @@ package xdb
 import "time"
 
 const (
-	DataDir           = "/Users/majunqiang/Documents/mrxdbengine/data/" // 段数据文件存放目录默认值
-	SegFNamePrefix    = "seg"                                           // 段数据文件名称前缀
-	HintFNamePrefix   = "hint"                                          // seg2Hint 文件名称前缀
-	Delimiter         = "_"                                             // 文件名分隔符
-	FileMode          = 0777                                            // 文件权限
-	SegFormat         = "%016x%02x%03x%s%s"                             // 段文件数据格式
-	CRCFormat         = "%08x%s\n"                                      // 段文件数据头部增加了CRC校验值的格式
-	SegFormatKV       = "%016x%02x%03x%s\n"                             // 段文件数据头部增加了CRC校验值的数据，将key和value合并为一个字符串的格式
-	NewLineSize       = len("\n")                                       // 字符串\n len
-	SegSizeLimit      = 1 * 1024 * 1024                                 // 段文件size最大值：1MB
-	SegFNameFormat    = "%3s_%d"                                        // 数据文件名称格式
-	HintFNameFormat   = "%4s_%d"                                        // hint文件名称格式
-	DataFNameFormat   = "%s_%d"                                         // 文件名称格式
-	DataDelimiterByte = '\n'                                            // 数据分隔符
-	SegFIDGap         = -50 * 365 * 24 * 3600 * time.Second             // 合并段文件ID与当前时间差值 -50年
-	HintFormat        = "%016x%02x%03x%016x%s\n"                        // hint文件数据格式
-	ASC               = 0                                               // 顺序
-	DESC              = 1                                               // 倒序
-	MaxSegmentNum     = 3                                               // 如果当前有超过MaxSegmentNum个冻结的段文件,就触发段合并，否则不进行段合并
-	HTTPPort          = 8088                                            // http 请求端口
+	DataDir                  = "/Users/majunqiang/Documents/mrxdbengine/data/" // 段数据文件存放目录默认值
+	SegFNamePrefix           = "seg"                                           // 段数据文件名称前缀
+	HintFNamePrefix          = "hint"                                          // seg2Hint 文件名称前缀
+	Delimiter                = "_"                                             // 文件名分隔符
+	FileMode                 = 0777                                            // 文件权限
+	SegFormat                = "%016x%016x%02x%02x%08x%02x%03x%s%s"            // 段文件数据格式
+	CRCFormat                = "%08x%s\n"                                      // 段文件数据头部增加了CRC校验值的格式
+	SegRecHeaderFormat       = "%08x%016x%016x%02x%02x%08x%02x%03x"            // 段文件记录中key之前的部分(CRC校验值及各长度固定的字段)的格式
+	SegRecHeaderSize         = 8 + 16 + 16 + 2 + 2 + 8 + 2 + 3                 // 段文件记录中key之前的部分的长度
+	NewLineSize              = len("\n")                                       // 字符串\n len
+	SegSizeLimit             = 1 * 1024 * 1024                                 // 段文件size最大值：1MB
+	SegFNameFormat           = "%3s_%d"                                        // 数据文件名称格式
+	HintFNameFormat          = "%4s_%d"                                        // hint文件名称格式
+	DataFNameFormat          = "%s_%d"                                         // 文件名称格式
+	DataDelimiterByte        = '\n'                                            // 数据分隔符
+	SegFIDGap                = -50 * 365 * 24 * 3600 * time.Second             // 合并段文件ID与当前时间差值 -50年
+	HintFormat               = "%016x%016x%02x%02x%08x%02x%03x%016x%s"         // hint文件数据格式，写入文件时头部增加CRC校验值(CRCFormat)
+	HintRecHeaderSize        = 8 + 16 + 16 + 2 + 2 + 8 + 2 + 3 + 16            // hint文件记录中key之前的部分(CRC校验值及各长度固定的字段)的长度
+	ASC                      = 0                                               // 顺序
+	DESC                     = 1                                               // 倒序
+	MaxSegmentNum            = 3                                               // 如果当前有超过MaxSegmentNum个冻结的段文件,就触发段合并，否则不进行段合并
+	HTTPPort                 = 8088                                            // http 请求端口
+	ManifestFName            = "MANIFEST"                                      // 数据文件清单名称
+	ManifestTmpFName         = "MANIFEST.tmp"                                  // 重写数据文件清单时使用的临时文件名称
+	ManifestAdd              = "+"                                             // 数据文件清单记录：新增文件
+	ManifestDel              = "-"                                             // 数据文件清单记录：删除文件
+	ManifestSeq              = "#"                                             // 数据文件清单记录：段文件切换时刻的最大序列号
+	ManifestMaxSeq           = "^"                                             // 数据文件清单记录：段文件中记录的最大序列号，格式：^段文件名称:序列号
+	ManifestMaxSeqSep        = ":"                                             // 数据文件清单记录：段文件名称与最大序列号的分隔符
+	ManifestCDCFloor         = "%"                                             // 数据文件清单记录：被段合并丢弃的记录中的最大序列号
+	ManifestEditSep          = ","                                             // 数据文件清单记录中各项变更的分隔符
+	ManifestRewriteLimit     = 1000                                            // 数据文件清单记录条数达到该值时重写清单
+	QuarantineFNamePrefix    = "quarantine"                                    // 隔离文件名称前缀
+	WatchBufferSize          = 1024                                            // 订阅者的事件缓冲区大小
+	IdxWorkerNum             = 8                                               // 引擎启动时并发解析段文件生成索引的goroutine数量
+	IdxSnapFName             = "INDEX"                                         // 内存索引快照文件名称
+	IdxSnapTmpFName          = "INDEX.tmp"                                     // 保存内存索引快照时使用的临时文件名称
+	IdxSnapMagic             = "XIDX"                                          // 内存索引快照文件头
+	CheckpointInterval       = 5 * time.Minute                                 // 定期保存内存索引快照的时间间隔
+	DefaultCompressThreshold = 256                                             // value 压缩阈值默认值，value 长度小于该值时不压缩
+	MaxKeySize               = 0xff                                            // 段文件中key(加密后)的最大长度
+	MaxValSize               = 0xfff                                           // 段文件中value(压缩、加密后)的最大长度
+	LockFName                = "LOCK"                                          // 数据目录锁文件名称
+	SegFMagic                = "XSEG"                                          // 段文件头magic
+	HintFMagic               = "XHNT"                                          // hint文件头magic
+	FHeaderFormat            = "%s%04x\n"                                      // 数据文件头格式：magic+格式版本号
+	FHeaderSize              = 9                                               // 数据文件头长度
+	FormatVersion            = 1                                               // 当前数据文件格式版本号，没有文件头的旧格式文件视为版本0
+	LegacySegFormatKV        = "%016x%02x%03x%s\n"                             // 版本0 段文件数据格式(CRC校验值之后的部分)
+	MigrateFNamePrefix       = "migrate"                                       // 迁移数据文件格式时使用的临时文件名称前缀
+	KindVal                  = 0                                               // 记录类型：value 直接保存在段文件中
+	KindBlob                 = 1                                               // 记录类型：value 保存在blob文件中，段文件中保存指向blob文件的指针
+	KindCommit               = 2                                               // 记录类型：批量写入的提交记录，value 为批量写入的记录条数
+	KindMerge                = 3                                               // 记录类型：合并操作数，value 为指向同一段文件中上一条记录的指针和操作数
+	KindDropBucket           = 4                                               // 记录类型：删除桶，key 为桶的内部前缀
+	BucketKeyPrefix          = "\x00"                                          // 桶中key的内部前缀分隔符
+	IndexKeyPrefix           = "\x00\x01"                                      // 二级索引项key的内部前缀
+	IndexEntryValue          = "1"                                             // 二级索引项、索引构建完成记录的value
+	CDCConsumerPrefix        = "\x00\x02\x00"                                  // CDC消费者已确认序列号的内部key前缀
+	ReservedKeyPrefix        = "\x00\x03"                                      // 保留给调用方使用的内部key前缀范围，通过ReservedPrefix获取其中的前缀
+	DropBucketValue          = "drop"                                          // 删除桶记录的value
+	FlagBatch                = 0x80                                            // 记录类型标记：批量写入中的记录，读到其后的提交记录时才生效
+	FlagMoved                = 0x40                                            // 记录类型标记：blob文件垃圾回收迁移value后写入的指针记录，序列号与原记录相同
+	BatchCommitKey           = "!batch"                                        // 批量写入提交记录的key
+	BlobFNamePrefix          = "blob"                                          // blob文件名称前缀
+	BlobFMagic               = "XBLB"                                          // blob文件头magic
+	BlobFormat               = "%016x%02x%08x%02x%08x%s%s"                     // blob文件数据格式(seq,codec,keyID,keysz,valsz,key,value)，写入文件时头部增加CRC校验值(CRCFormat)
+	BlobRecHeaderSize        = 8 + 16 + 2 + 8 + 2 + 8                          // blob文件记录中key之前的部分(CRC校验值及各长度固定的字段)的长度
+	BlobPtrFormat            = "%016x%016x%08x"                                // blob指针格式(blob文件时间戳,valops,valsz)，作为KindBlob记录的value保存在段文件中
+	BlobPtrSize              = 16 + 16 + 8                                     // blob指针长度
+	BlobSizeLimit            = 8 * 1024 * 1024                                 // blob文件size最大值：8MB
+	MaxBlobValSize           = 0xffffffff                                      // blob文件中value的最大长度
+	DefaultBlobThreshold     = 1024                                            // value(压缩、加密后)长度超过该值时保存到blob文件，默认值
+	MergePtrFormat           = "%016x%03x%02x%02x%08x%02x"                     // 合并操作数记录中指向上一条记录的指针：valops、valsz、kind、codec、keyID、操作数链长度
+	MergePtrSize             = 16 + 3 + 2 + 2 + 8 + 2                          // 合并操作数记录指针长度
+	MaxMergeOps              = 16                                              // 操作数链的最大长度，超过后写入合并后的完整value
+	BlobGCRatio              = 0.5                                             // blob文件中失效数据占比达到该值时，触发blob文件垃圾回收
 )
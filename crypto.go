@@ -0,0 +1,157 @@
+package xdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// KeyProvider 数据加密密钥提供者，由调用方实现(例如对接KMS)
+// 引擎每次写入数据时调用CurrentKey获取当前密钥，实现方应自行缓存；密钥轮换后，旧密钥仍需能通过Key获取，
+// 直到段合并将使用旧密钥加密的数据全部使用新密钥重新加密
+type KeyProvider interface {
+	CurrentKey() (uint32, []byte, error) // 返回当前用于加密的密钥标识及密钥(16/24/32字节)，密钥标识不能为0
+	Key(id uint32) ([]byte, error)       // 返回密钥标识对应的密钥，用于解密
+}
+
+// cryptor 使用AES-GCM对段文件中的key、value以及hint文件中的key进行加解密
+// 密文格式：nonce | ciphertext；加密value时使用value所属的key作为附加数据(AAD)，密文被移动到其他key的记录中时解密失败
+type cryptor struct {
+	kp    KeyProvider            // 密钥提供者
+	aeads map[uint32]cipher.AEAD // 密钥标识对应的AEAD
+	mu    sync.Mutex             // aeads 锁
+}
+
+// newCryptor 创建cryptor；kp为nil时返回nil，表示不加密
+func newCryptor(kp KeyProvider) *cryptor {
+	if kp == nil {
+		return nil
+	}
+	return &cryptor{kp: kp, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// currentKeyID 返回当前用于加密的密钥标识；未启用加密时返回0
+func (c *cryptor) currentKeyID() (uint32, error) {
+	if c == nil {
+		return 0, nil
+	}
+	id, key, err := c.kp.CurrentKey()
+	if err != nil {
+		return 0, fmt.Errorf("get current key error: %v", err)
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("key id can not be 0")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.aeads[id]; !ok {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return 0, fmt.Errorf("key: %d error: %v", id, err)
+		}
+		c.aeads[id] = aead
+	}
+	return id, nil
+}
+
+// aead 获取密钥标识对应的AEAD
+func (c *cryptor) aead(id uint32) (cipher.AEAD, error) {
+	if c == nil {
+		return nil, fmt.Errorf("data encrypted with key: %d, but no key provider configured", id)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+	key, err := c.kp.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("get key: %d error: %v", id, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("key: %d error: %v", id, err)
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// seal 使用密钥标识id对应的密钥加密数据，aad为附加数据
+func (c *cryptor) seal(id uint32, plain, aad []byte) ([]byte, error) {
+	aead, err := c.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce error: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+// open 使用密钥标识id对应的密钥解密数据，aad为加密时的附加数据
+func (c *cryptor) open(id uint32, sealed, aad []byte) ([]byte, error) {
+	aead, err := c.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short: %d", len(sealed))
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with key: %d error: %v", id, err)
+	}
+	return plain, nil
+}
+
+// sealKey 加密key，密文使用base64编码，以便写入文本格式的段文件和hint文件；keyID为0时不加密
+func (c *cryptor) sealKey(keyID uint32, key string) (string, error) {
+	if keyID == 0 {
+		return key, nil
+	}
+	sealed, err := c.seal(keyID, []byte(key), nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openKey 解密sealKey加密的key
+func (c *cryptor) openKey(keyID uint32, stored string) (string, error) {
+	if keyID == 0 {
+		return stored, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", fmt.Errorf("base64 decode key error: %v", err)
+	}
+	key, err := c.open(keyID, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// sealVal 加密key的value，使用key作为附加数据
+func (c *cryptor) sealVal(id uint32, key string, plain []byte) ([]byte, error) {
+	return c.seal(id, plain, []byte(key))
+}
+
+// openVal 解密key的value，使用key作为附加数据
+func (c *cryptor) openVal(id uint32, key string, sealed []byte) ([]byte, error) {
+	return c.open(id, sealed, []byte(key))
+}
+
+// newAEAD 使用密钥创建AES-GCM
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -7,22 +7,58 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // DBEngine 是存储引擎，完成段的创建、索引的更新、段的合并和压缩
 type DBEngine struct {
-	dataDir    string             // 数据文件保存目录
-	segFName   string             // 当前处于active的段文件名称
-	memIdx     map[string]MemIdxV // 内存hashmap 索引
-	segFMu     sync.Mutex         // 当前活跃段文件锁
-	memIdxMu   sync.Mutex         // 内存索引锁
-	segMergeMu sync.Mutex         // 段合并锁
+	dataDir           string                         // 数据文件保存目录
+	codec             Codec                          // value 压缩编解码器
+	crypt             *cryptor                       // 数据加密器，为nil时不加密
+	compressThreshold int                            // value 压缩阈值
+	blobThreshold     int                            // value 长度超过该值时保存到blob文件
+	segFName          string                         // 当前处于active的段文件名称
+	segFHinted        bool                           // 重新打开的活跃段文件已生成hint文件，首次追加写入前使hint文件失效，由segFMu保护
+	blobFName         string                         // 当前处于active的blob文件名称，由segFMu保护
+	seq               uint64                         // 最近一次写入的记录的序列号，由segFMu保护
+	memIdx            map[string]MemIdxV             // 内存hashmap 索引
+	keySets           map[string]map[string]struct{} // 按分组前缀(桶、二级索引的索引词、CDC消费者)保存的key集合，避免按前缀查找时遍历全部key，由memIdxMu保护
+	secIdxs           map[string]*secIndex           // 按Options.Indexes注册的二级索引，Open之后不再修改
+	retention         Retention                      // 历史版本保留策略
+	versions          map[string][]MemIdxV           // 保留范围内的历史版本，未启用保留策略时为nil，由memIdxMu保护
+	manifest          *manifest                      // 数据文件清单
+	lockF             *os.File                       // 数据目录锁文件
+	recovery          *RecoveryInfo                  // 启动时活跃段文件的恢复结果
+	closed            atomic.Bool                    // 引擎是否已关闭：Close开始时设置，之后的写入、段合并和blob文件垃圾回收不再进行
+	stopCh            chan struct{}                  // 引擎关闭时通知后台goroutine退出
+	bgWg              sync.WaitGroup                 // 后台goroutine(定期保存索引快照等)
+	segFMu            sync.Mutex                     // 当前活跃段文件锁
+	memIdxMu          sync.RWMutex                   // 内存索引锁
+	segMergeMu        sync.Mutex                     // 段合并锁
+	snapGen           uint64                         // 最近一次创建的快照编号，由snapMu保护
+	snaps             map[uint64]*DBSnapshot         // 尚未释放的快照，由snapMu保护
+	pendingDels       []pendingDel                   // 等待快照释放后删除的数据文件，由snapMu保护
+	snapMu            sync.Mutex                     // 快照锁
+	watchGen          uint64                         // 最近一次创建的订阅编号，由watchMu保护
+	watchers          map[uint64]*watcher            // 订阅者，由watchMu保护
+	watchMu           sync.Mutex                     // 订阅锁
 }
 
 var dbEngine *DBEngine // 数据库引擎对象，全局唯一
 
+// checkOpen 引擎未打开或已关闭时返回ErrClosed
+func (engine *DBEngine) checkOpen() error {
+	if engine == nil || engine.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
 // segFLen 获取当前活跃段文件长度
 func (engine *DBEngine) segFLen(fName string) int64 {
 	fPath := path.Join(engine.dataDir, fName)
@@ -33,194 +69,619 @@ func (engine *DBEngine) segFLen(fName string) int64 {
 	return len
 }
 
-// appendSeg 将数据写入段文件
+// appendSeg 为数据分配序列号并写入段文件，在持有段文件锁期间更新索引，保证索引与段文件内容一致
 func (engine *DBEngine) appendSeg(seg *Segment) error {
 	engine.segFMu.Lock()
 	defer engine.segFMu.Unlock()
+	return engine.appendSegLocked(seg)
+}
+
+// appendSegLocked 同appendSeg，调用方需持有segFMu
+func (engine *DBEngine) appendSegLocked(seg *Segment) error {
+	return engine.writeSegsLocked([]*Segment{seg})
+}
+
+// writeBatchLocked 将多条记录作为一个批量写入原子地追加到段文件：记录增加批量写入标记，之后追加一条提交记录；调用方需持有segFMu
+func (engine *DBEngine) writeBatchLocked(segs []*Segment) error {
+	count := strconv.Itoa(len(segs))
+	for _, seg := range segs {
+		seg.kind |= FlagBatch
+	}
+	return engine.writeSegsLocked(append(segs, &Segment{
+		value: count,
+		Hint: Hint{
+			key:   BatchCommitKey,
+			keysz: len(BatchCommitKey),
+			val:   val{tm: time.Now().UnixNano(), kind: KindCommit, valsz: len(count)},
+		},
+	}))
+}
+
+// writeSegsLocked 为记录分配序列号，通过一次写入将全部记录写入段文件，然后更新索引；调用方需持有segFMu
+func (engine *DBEngine) writeSegsLocked(segs []*Segment) error {
+	// Close 持有segFMu生成hint文件、保存索引快照，之后不再写入
+	if engine.closed.Load() {
+		return ErrClosed
+	}
 	// 若不存在段文件，或者检测当前段文件大小，若超过限制则重新创建段文件
-	if engine.segFName == "" || dbEngine.segFLen(engine.segFName) >= SegSizeLimit {
+	if engine.segFName == "" || engine.segFLen(engine.segFName) >= SegSizeLimit {
 		segFName, err := engine.newDataF(SegFNameFormat, SegFNamePrefix, time.Now().UnixNano())
 		if err != nil {
 			slogger.Fatalf("create segment file errror: %v", err)
 		}
+		if err = engine.manifest.commitSeq([]string{segFName}, nil, engine.seq); err != nil {
+			slogger.Fatalf("record segment file: %s to manifest error: %v", segFName, err)
+		}
+		frozenFName := engine.segFName
 		engine.segFName = segFName
 		slogger.Infof("new segment created, active segment file: %s\n", segFName)
-		// 启动段合并流程
-		go engine.segMerge()
+		// 为冻结的段文件生成hint文件，然后启动段合并流程
+		go engine.freezeSegF(frozenFName)
+	}
+	// 重新打开的活跃段文件的hint文件不再覆盖追加的记录，首次写入前将其从MANIFEST中删除，段文件切换或引擎关闭时重新生成
+	if engine.segFHinted {
+		hintFName, _ := compFName(engine.segFName, SegFNamePrefix)
+		if err := engine.manifest.commitSeq(nil, []string{hintFName}, 0); err != nil {
+			slogger.Fatalf("remove hint file: %s from manifest error: %v", hintFName, err)
+		}
+		engine.removeDataFs([]string{hintFName})
+		engine.segFHinted = false
 	}
 	segFile, err := os.OpenFile(path.Join(engine.dataDir, engine.segFName), os.O_APPEND|os.O_WRONLY, FileMode)
 	defer segFile.Close()
 	if err != nil {
-		return fmt.Errorf("idxK: %s, value: %s, write segment file error: %v\n", seg.key, seg.value, err)
+		return fmt.Errorf("write segment file: %s error: %v\n", engine.segFName, err)
+	}
+	offset := engine.segFLen(engine.segFName)
+	seq := engine.seq
+	var buf strings.Builder
+	for _, seg := range segs {
+		// blob文件垃圾回收迁移的记录保留原序列号，其他记录按写入顺序分配序列号
+		if seg.seq == 0 {
+			seq++
+			seg.seq = seq
+		}
+		// value 超过阈值时保存到blob文件，段文件中只保存指向blob文件的指针
+		if seg.kind&^FlagBatch == KindVal && len(seg.value) > engine.blobThreshold {
+			ptr, err := engine.writeBlob(seg)
+			if err != nil {
+				return fmt.Errorf("idxK: %s, write blob file error: %v", seg.key, err)
+			}
+			seg.kind, seg.value, seg.valsz = KindBlob|seg.kind&FlagBatch, ptr, len(ptr)
+		}
+		dataStr, err := encodeSeg(seg, engine.crypt)
+		if err != nil {
+			return fmt.Errorf("encode seg key: %s error: %v", seg.key, err)
+		}
+		buf.WriteString(dataStr)
+		seg.valops = offset + int64(buf.Len()-NewLineSize-seg.valsz)
 	}
-	dataStr := encodeSeg(seg)
-	_, err = segFile.WriteString(dataStr)
+	_, err = segFile.WriteString(buf.String())
 	if err != nil {
 		return fmt.Errorf("write seg to file: %s error: %v", engine.segFName, err)
 	}
+	if seq > engine.seq {
+		engine.seq = seq
+	}
+	// 更新索引，然后通知订阅者
+	for _, seg := range segs {
+		if seg.kind != KindCommit {
+			engine.updMemIdx(segment2MemIndex(seg, engine.segFName))
+		}
+	}
+	engine.notify(segs)
 	return nil
 }
 
 // freezeSegFs 获取已经冻结的所有段文件列表
-func (engine *DBEngine) freezeSegFs() []os.DirEntry {
-	dataFs := getDataFs(engine.dataDir, SegFNamePrefix, 1)
-	return dataFs[1:] // 时间戳最大的段文件为当前活跃段
+func (engine *DBEngine) freezeSegFs() []string {
+	engine.segFMu.Lock()
+	activeFName := engine.segFName
+	engine.segFMu.Unlock()
+	segFs := make([]string, 0)
+	for _, name := range engine.manifest.liveFs(SegFNamePrefix) {
+		if name != activeFName {
+			segFs = append(segFs, name)
+		}
+	}
+	return segFs
+}
+
+// compF 段合并时正在写入的段文件及其hint文件
+type compF struct {
+	segFName  string        // 段文件名称
+	hintFName string        // hint文件名称
+	segF      *os.File      // 段文件
+	hintF     *os.File      // hint文件
+	segW      *bufio.Writer // 段文件writer
+	hintW     *bufio.Writer // hint文件writer
+	offset    int64         // 段文件当前写入位置
+	maxSeq    uint64        // 已写入的记录中的最大序列号
+}
+
+// openCompF 创建并打开段合并生成的段文件和hint文件
+func (engine *DBEngine) openCompF() *compF {
+	segFName, hintFName, _ := engine.newCompF()
+	segF, errOpenSegF := os.OpenFile(path.Join(engine.dataDir, segFName), os.O_APPEND|os.O_WRONLY, FileMode)
+	hintF, errOpenHintF := os.OpenFile(path.Join(engine.dataDir, hintFName), os.O_APPEND|os.O_WRONLY, FileMode)
+	if errOpenSegF != nil || errOpenHintF != nil {
+		slogger.Fatalf("open new seg file or hint file error: %v,%v", errOpenSegF, errOpenHintF)
+	}
+	return &compF{
+		segFName:  segFName,
+		hintFName: hintFName,
+		segF:      segF,
+		hintF:     hintF,
+		segW:      bufio.NewWriter(segF),
+		hintW:     bufio.NewWriter(hintF),
+		offset:    FHeaderSize,
+	}
+}
+
+// close 将缓冲数据写入段文件和hint文件，刷盘后关闭文件
+func (c *compF) close() error {
+	defer c.segF.Close()
+	defer c.hintF.Close()
+	if err := c.segW.Flush(); err != nil {
+		return fmt.Errorf("flush segment file: %s error: %v", c.segFName, err)
+	}
+	if err := c.hintW.Flush(); err != nil {
+		return fmt.Errorf("flush hint file: %s error: %v", c.hintFName, err)
+	}
+	if err := c.segF.Sync(); err != nil {
+		return fmt.Errorf("sync segment file: %s error: %v", c.segFName, err)
+	}
+	if err := c.hintF.Sync(); err != nil {
+		return fmt.Errorf("sync hint file: %s error: %v", c.hintFName, err)
+	}
+	return nil
+}
+
+// writeSeg 将记录写入合并生成的段文件(不写入hint文件)，并设置记录中value的位置
+func (c *compF) writeSeg(seg *Segment, crypt *cryptor) error {
+	segStr, err := encodeSeg(seg, crypt)
+	if err != nil {
+		return err
+	}
+	n, err := c.segW.WriteString(segStr)
+	if err != nil {
+		return fmt.Errorf("write new segment: %s error: %v", c.segFName, err)
+	}
+	c.offset = c.offset + int64(n)
+	seg.valops = c.offset - int64(NewLineSize+seg.valsz)
+	return nil
 }
 
 // segMerge 段合并
+// 合并生成的文件与被合并的文件在一条MANIFEST记录中原子地完成替换，之后才会删除被合并的文件
 func (engine *DBEngine) segMerge() {
 	engine.segMergeMu.Lock() // 加锁，每次只允许一个goroutine 进行段合并操作
 	defer engine.segMergeMu.Unlock()
+	if engine.closed.Load() {
+		return
+	}
 
 	//1.获取已冻结的段文件列表
-	segFs := engine.freezeSegFs()
+	segFs := engine.consumedSegFs(engine.freezeSegFs())
 	if len(segFs) < MaxSegmentNum {
 		return
 	}
+	engine.pruneVersions()
 	// 2. 创建新的段文件和hint file，作为段合并后的数据存储文件
-	newSegFName, hintFName, _ := engine.newCompF()
-	newSegF, errOpenSegF := os.OpenFile(path.Join(engine.dataDir, newSegFName), os.O_WRONLY|os.O_WRONLY, FileMode)
-	hintF, errOpenHintF := os.OpenFile(path.Join(engine.dataDir, hintFName), os.O_WRONLY|os.O_WRONLY, FileMode)
-	if errOpenSegF != nil || errOpenHintF != nil {
-		slogger.Fatalf("open new seg file or hint file error: %v,%v", errOpenSegF, errOpenHintF)
+	adds, dels := make([]string, 0), make([]string, 0)
+	maxSeqs := make(map[string]uint64) // 合并生成的段文件中记录的最大序列号
+	comp := engine.openCompF()
+	// closeComp 关闭当前合并生成的文件；若文件中没有数据则直接删除
+	closeComp := func() {
+		if err := comp.close(); err != nil {
+			slogger.Fatalf("close merged files error: %v", err)
+		}
+		if comp.offset == FHeaderSize {
+			removeCompF(engine.dataDir, comp.segFName, SegFNamePrefix)
+			return
+		}
+		adds = append(adds, comp.segFName, comp.hintFName)
+		maxSeqs[comp.segFName] = comp.maxSeq
 	}
-	defer newSegF.Close()
-	defer hintF.Close()
-	newSegWriter := bufio.NewWriter(newSegF)
-	hintWriter := bufio.NewWriter(hintF)
-	var offset int64
 	// 3. 遍历已冻结的段文件列表
-	for _, segF := range segFs {
+	var mergedSeq uint64 // 被合并的记录中的最大序列号
+	for _, segFName := range segFs {
 		// 如果当前的合并生成的段文件大小超过阈值，创建新的段文件
-		if dbEngine.segFLen(newSegFName) > SegSizeLimit {
-			newSegFName, hintFName, _ = engine.newCompF()
-			newSegF, errOpenSegF = os.OpenFile(path.Join(engine.dataDir, newSegFName), os.O_WRONLY|os.O_WRONLY, FileMode)
-			hintF, errOpenHintF = os.OpenFile(path.Join(engine.dataDir, hintFName), os.O_WRONLY|os.O_WRONLY, FileMode)
-			if errOpenSegF != nil || errOpenHintF != nil {
-				slogger.Fatalf("open new seg file or hint file error: %v,%v", errOpenSegF, errOpenHintF)
-			}
-			defer newSegF.Close()
-			defer hintF.Close()
-			newSegWriter = bufio.NewWriter(newSegF)
-			hintWriter = bufio.NewWriter(hintF)
-		}
-		// 3.0 逐行读取原段文件的数据
-		f, err := os.OpenFile(path.Join(engine.dataDir, segF.Name()), os.O_RDONLY, FileMode)
-		defer f.Close()
+		if comp.offset > SegSizeLimit {
+			closeComp()
+			comp = engine.openCompF()
+		}
+		// 3.0 逐条读取原段文件的数据
+		f, reader, err := openDataF(path.Join(engine.dataDir, segFName), SegFMagic)
 		if err != nil {
-			slogger.Fatalf("open seg file: %s error: %v", segF.Name(), err)
+			slogger.Fatalf("open seg file: %s error: %v", segFName, err)
 		}
-		reader := bufio.NewReader(f)
-		dataStr, err1 := reader.ReadString(DataDelimiterByte)
+		dataStr, err1 := readSeg(reader)
 		for !errors.Is(err1, io.EOF) {
 			if err1 != nil {
-				slogger.Errorf("read segment file: %s error: %v", segF.Name(), err1)
+				slogger.Errorf("read segment file: %s error: %v", segFName, err1)
 			}
-			seg, err := decodeSeg(dataStr)
+			seg, err := decodeSeg(dataStr, engine.crypt)
 			if err != nil {
 				slogger.Errorf("decodeHint data: %s error: %v", dataStr, err)
+				dataStr, err1 = readSeg(reader)
+				continue
+			}
+			if seg.seq > mergedSeq {
+				mergedSeq = seg.seq
 			}
-			// 3.1 对于尚未处理且新增/更新的key,进行处理
-			if idx, ok := engine.memIdx[seg.key]; ok && idx.fName == segF.Name() && idx.tm == seg.tm {
+			// 3.1 对于尚未处理且新增/更新的key,以及保留范围内的历史版本,进行处理
+			idx, ok := engine.getMemIdx(seg.key)
+			cur := ok && idx.fName == segFName && idx.seq == seg.seq
+			if !cur {
+				idx, ok = engine.getVersion(seg.key, seg.seq)
+				ok = ok && idx.fName == segFName
+			}
+			if ok {
+				// 索引中的记录已经生效，去掉批量写入标记；原记录不会被复制，去掉迁移标记
+				seg.kind &^= FlagBatch | FlagMoved
+				switch seg.kind {
+				case KindVal:
+					// 使用旧密钥加密的数据，使用当前密钥重新加密；blob文件中的value在blob文件垃圾回收时重新加密
+					if seg.valsz == 0 {
+						break // 保留的删除记录
+					}
+					if seg.value, seg.keyID, err = engine.resealVal(seg.key, seg.value, seg.codec, seg.keyID); err != nil {
+						slogger.Fatalf("re-encrypt segment: %s key: %s error: %v", segFName, seg.key, err)
+					}
+					seg.valsz = len(seg.value)
+				case KindMerge:
+					// 操作数链合并为完整的value
+					if err = engine.foldMergeSeg(seg, idx); err != nil {
+						// 无法合并时(例如操作数不合法)原样复制操作数链，读取该key时返回合并错误
+						slogger.Errorf("fold merge operands segment: %s key: %s error: %v, copy operands as is", segFName, seg.key, err)
+						if err = engine.copyMergeChain(comp, seg, idx); err != nil {
+							slogger.Fatalf("copy merge operands segment: %s key: %s error: %v", segFName, seg.key, err)
+						}
+					}
+				}
 				// 写入新的segment 文件
-				n, err := newSegWriter.WriteString(encodeSeg(seg))
-				if err != nil {
-					slogger.Errorf("write new segment: %s data: %v error: %v", newSegFName, seg, err)
+				if err = comp.writeSeg(seg, engine.crypt); err != nil {
+					slogger.Fatalf("write segment: %s key: %s to: %s error: %v", segFName, seg.key, comp.segFName, err)
+				}
+				if seg.seq > comp.maxSeq {
+					comp.maxSeq = seg.seq
 				}
-				offset = offset + int64(n)
-				seg.valops = offset - int64(NewLineSize+seg.valsz)
 				// 写入hint 文件
 				hint := seg2Hint(seg)
-				_, err = hintWriter.WriteString(encodeHint(hint))
+				hintStr, err := encodeHint(hint, engine.crypt)
+				if err == nil {
+					_, err = comp.hintW.WriteString(hintStr)
+				}
 				if err != nil {
 					slogger.Errorf("write seg2Hint: %v error: %v", hint, err)
 				}
 				// 更新索引
-				engine.updMemIdx(segment2MemIndex(seg, newSegFName))
+				if cur {
+					engine.updMemIdx(segment2MemIndex(seg, comp.segFName))
+				} else {
+					engine.relocVersion(segment2MemIndex(seg, comp.segFName))
+				}
 			}
-			dataStr, err1 = reader.ReadString(DataDelimiterByte)
+			dataStr, err1 = readSeg(reader)
+		}
+		f.Close()
+		dels = append(dels, segFName)
+		if hintFName, _ := compFName(segFName, SegFNamePrefix); engine.manifest.isLive(hintFName) {
+			dels = append(dels, hintFName)
 		}
-		// 3.2 删除已经合并完成的段文件和其hint文件(若存在)
-		removeCompF(engine.dataDir, segF.Name(), SegFNamePrefix)
-		slogger.Infof("merge segment %s done!\n", segF.Name())
+		slogger.Infof("merge segment %s done!\n", segFName)
+	}
+	closeComp()
+	// 4. 将合并结果记录到MANIFEST；被合并的记录中被覆盖的记录不再能通过CDC读取，同时记录被合并的记录中的最大序列号
+	if err := engine.manifest.commitEdit(manifestEdit{adds: adds, dels: dels, maxSeqs: maxSeqs, floor: mergedSeq}); err != nil {
+		slogger.Fatalf("record merge result to manifest error: %v", err)
 	}
-	slogger.Infof("merge segment done! merge segment num: %d to segment: %s\n", len(segFs), newSegFName)
+	// 5. 删除已经合并完成的段文件和其hint文件(若存在)，仍被快照引用的文件在快照释放后删除
+	engine.removeDataFs(dels)
+	slogger.Infof("merge segment done! merge segment num: %d to segment: %v\n", len(segFs), adds)
 }
 
-// isExistHint 判断当前文件是否存在hint文件
+// isExistCompF 判断当前文件的伙伴文件(段文件对应的hint文件，或hint文件对应的段文件)是否为有效文件
 func (engine *DBEngine) isExistCompF(fName, prefix string) bool {
 	name, err := compFName(fName, prefix)
 	if err != nil {
 		slogger.Fatalf("compFName error: %v", err)
 	}
-	return isExistF(path.Join(engine.dataDir, name))
+	return engine.manifest.isLive(name)
+}
+
+// freezeSegF 段文件切换后，为被冻结的段文件生成hint文件，然后启动段合并流程
+func (engine *DBEngine) freezeSegF(segFName string) {
+	if segFName != "" {
+		engine.hintFrozenSegF(segFName)
+	}
+	engine.segMerge()
+}
+
+// hintFrozenSegF 为已冻结且尚未生成hint文件的段文件生成hint文件
+func (engine *DBEngine) hintFrozenSegF(segFName string) {
+	engine.segMergeMu.Lock()
+	defer engine.segMergeMu.Unlock()
+	// 段文件可能已经被合并
+	if !engine.closed.Load() && engine.manifest.isLive(segFName) && !engine.isExistCompF(segFName, SegFNamePrefix) {
+		if err := engine.writeHintF(segFName); err != nil {
+			slogger.Errorf("write hint file for segment: %s error: %v", segFName, err)
+		}
+	}
+}
+
+// writeHintF 扫描段文件，为其生成hint文件，刷盘后与段文件中记录的最大序列号一起记录到MANIFEST
+func (engine *DBEngine) writeHintF(segFName string) error {
+	hintFName, err := compFName(segFName, SegFNamePrefix)
+	if err != nil {
+		return err
+	}
+	segPath := path.Join(engine.dataDir, segFName)
+	f, reader, err := openDataF(segPath, SegFMagic)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hintPath := path.Join(engine.dataDir, hintFName)
+	hintF, err := os.OpenFile(hintPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, FileMode)
+	if err != nil {
+		return fmt.Errorf("create hint file: %s error: %v", hintPath, err)
+	}
+	defer hintF.Close()
+	hintWriter := bufio.NewWriter(hintF)
+	hintWriter.WriteString(encodeFHeader(HintFMagic))
+	var maxSeq uint64
+	_, err = engine.scanSegF(reader, FHeaderSize, func(seg *Segment) error {
+		if seg.seq > maxSeq {
+			maxSeq = seg.seq
+		}
+		hintStr, err := encodeHint(seg2Hint(seg), engine.crypt)
+		if err != nil {
+			return fmt.Errorf("encode hint key: %s error: %v", seg.key, err)
+		}
+		if _, err = hintWriter.WriteString(hintStr); err != nil {
+			return fmt.Errorf("write hint file: %s error: %v", hintPath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan segment file: %s error: %v", segPath, err)
+	}
+	if err = hintWriter.Flush(); err != nil {
+		return fmt.Errorf("flush hint file: %s error: %v", hintPath, err)
+	}
+	if err = hintF.Sync(); err != nil {
+		return fmt.Errorf("sync hint file: %s error: %v", hintPath, err)
+	}
+	return engine.manifest.commitEdit(manifestEdit{adds: []string{hintFName}, maxSeqs: map[string]uint64{segFName: maxSeq}})
 }
 
-// genIndexStr 生成IndexValue
+// updMemIdx 使用记录生成的索引项更新内存索引(删除记录删除索引项)，并记录key的历史版本
 func (engine *DBEngine) updMemIdx(memIdx *MemIdx) {
-	// 校验时间戳
+	engine.memIdxMu.Lock()
+	defer engine.memIdxMu.Unlock()
+	engine.putVersion(memIdx)
+	// 校验序列号，已有更新的索引项时忽略该记录
 	preIndex, ok := engine.memIdx[memIdx.idxK]
-	if ok && preIndex.tm > memIdx.idxV.tm {
+	if ok && isStale(preIndex, memIdx.idxV) {
 		return
 	}
-	engine.memIdxMu.Lock()
-	defer engine.memIdxMu.Unlock()
 
 	if memIdx.idxV.valsz > 0 {
-		engine.memIdx[memIdx.idxK] = memIdx.idxV
+		engine.setMemIdx(memIdx.idxK, memIdx.idxV)
 	} else {
-		delete(engine.memIdx, memIdx.idxK)
+		engine.delMemIdx(memIdx.idxK)
+	}
+}
+
+// setMemIdx 写入索引项，同时维护key所属的分组key集合；调用方需持有memIdxMu
+func (engine *DBEngine) setMemIdx(key string, idxV MemIdxV) {
+	engine.memIdx[key] = idxV
+	if group, ok := keyGroup(key); ok {
+		keys, ok := engine.keySets[group]
+		if !ok {
+			keys = make(map[string]struct{})
+			engine.keySets[group] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// delMemIdx 删除索引项，同时维护key所属的分组key集合；调用方需持有memIdxMu
+func (engine *DBEngine) delMemIdx(key string) {
+	delete(engine.memIdx, key)
+	if group, ok := keyGroup(key); ok {
+		delete(engine.keySets[group], key)
+		if len(engine.keySets[group]) == 0 {
+			delete(engine.keySets, group)
+		}
+	}
+}
+
+// initKeySets 内存索引整体替换(加载索引快照)后，重新生成分组key集合，同时返回内存索引中的删除桶记录(内部前缀->序列号)
+func (engine *DBEngine) initKeySets() map[string]uint64 {
+	engine.memIdxMu.Lock()
+	defer engine.memIdxMu.Unlock()
+	engine.keySets = make(map[string]map[string]struct{})
+	drops := make(map[string]uint64)
+	for k, v := range engine.memIdx {
+		engine.setMemIdx(k, v)
+		if v.kind == KindDropBucket {
+			drops[k] = v.seq
+		}
+	}
+	return drops
+}
+
+// groupKeys 按字典序返回分组中去掉分组前缀后的key
+func (engine *DBEngine) groupKeys(group string) []string {
+	engine.memIdxMu.RLock()
+	defer engine.memIdxMu.RUnlock()
+	keys := make([]string, 0, len(engine.keySets[group]))
+	for k := range engine.keySets[group] {
+		keys = append(keys, k[len(group):])
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// getMemIdx 获取key对应的索引项
+func (engine *DBEngine) getMemIdx(key string) (MemIdxV, bool) {
+	engine.memIdxMu.RLock()
+	defer engine.memIdxMu.RUnlock()
+	idxV, ok := engine.memIdx[key]
+	return idxV, ok
+}
+
+// isStale 序列号规则：若已存在的索引项pre的序列号比idxV大，则idxV为旧数据
+func isStale(pre, idxV MemIdxV) bool {
+	return pre.seq > idxV.seq
+}
+
+// fileIdx 从单个数据文件解析得到的索引，与内存索引不同，其中保留了删除记录(valsz为0)
+type fileIdx map[string]MemIdxV
+
+// maxSeq 返回fileIdx中的最大序列号
+func (idx fileIdx) maxSeq() uint64 {
+	var seq uint64
+	for _, v := range idx {
+		if v.seq > seq {
+			seq = v.seq
+		}
+	}
+	return seq
+}
+
+// put 按照序列号规则将索引项合并到fileIdx中；序列号相同时(blob文件垃圾回收迁移的记录)，较早创建的数据文件中的记录为旧数据，
+// 同一文件中后写入的记录覆盖先写入的记录
+func (idx fileIdx) put(memIdx *MemIdx) {
+	if pre, ok := idx[memIdx.idxK]; ok && (isStale(pre, memIdx.idxV) || pre.seq == memIdx.idxV.seq && isNewerF(pre.fName, memIdx.idxV.fName)) {
+		return
+	}
+	idx[memIdx.idxK] = memIdx.idxV
+}
+
+// isNewerF 判断数据文件fName是否比other创建得晚(按文件名称中的时间戳比较，段合并生成的文件早于其他段文件)
+func isNewerF(fName, other string) bool {
+	tm, _ := parseTm(Delimiter, fName)
+	otherTm, _ := parseTm(Delimiter, other)
+	return tm > otherTm
+}
+
+// prsHintF 根据hint文件内容生成索引
+// 先校验hint文件中的全部记录，任意一条记录校验失败(或文件尾部残缺)都返回错误
+func (engine *DBEngine) prsHintF(hintPath string) (fileIdx, error) {
+	idx := make(fileIdx)
+	if err := engine.scanHintF(hintPath, idx.put); err != nil {
+		return nil, err
 	}
+	return idx, nil
 }
 
-// prsHintF 根据hint文件内容更新索引
-func (engine *DBEngine) prsHintF(hintPath string) {
+// scanHintF 逐条读取hint文件，对每条记录生成的索引项调用fn
+func (engine *DBEngine) scanHintF(hintPath string, fn func(memIdx *MemIdx)) error {
 	segFName, err := compFName(path.Base(hintPath), HintFNamePrefix)
 	if err != nil {
 		slogger.Fatalf("company hintF name error: %v", err)
 	}
-	hintF, err := os.OpenFile(hintPath, os.O_RDONLY, FileMode)
-	defer hintF.Close()
+	hintF, reader, err := openDataF(hintPath, HintFMagic)
 	if err != nil {
-		slogger.Fatalf("open hintF: %s path error: %v", hintPath, err)
+		return err
 	}
-	reader := bufio.NewReader(hintF)
+	defer hintF.Close()
 	dataStr, err := reader.ReadString(DataDelimiterByte)
 	for !errors.Is(err, io.EOF) {
-		hint, err1 := decodeHint(dataStr)
-		if err1 == nil {
-			engine.updMemIdx(hint2MemIndex(hint, segFName))
-		} else {
-			slogger.Infof("decodeHint: %s error: %v", dataStr, err1)
+		if err != nil {
+			return fmt.Errorf("read hintF: %s error: %v", hintPath, err)
 		}
+		hint, err1 := decodeHint(dataStr, engine.crypt)
+		if err1 != nil {
+			return err1
+		}
+		fn(hint2MemIndex(hint, segFName))
 		dataStr, err = reader.ReadString(DataDelimiterByte)
 	}
+	if len(dataStr) > 0 {
+		return fmt.Errorf("hintF: %s broken tail: %s", hintPath, dataStr)
+	}
+	return nil
 }
 
-// prsSegF 根据段文件生成内存索引
-func (engine *DBEngine) prsSegF(segPath string) {
-	f, err := os.OpenFile(segPath, os.O_RDONLY, FileMode)
-	defer f.Close()
+// prsSegF 从from位置开始扫描段文件生成索引
+func (engine *DBEngine) prsSegF(segPath string, from int64) fileIdx {
+	f, reader, err := openDataF(segPath, SegFMagic)
 	if err != nil {
 		slogger.Fatalf("open f: %s error: %v", segPath, err)
 	}
-	reader := bufio.NewReader(f)
-	var offset int64 // 当前文件读取位置
-	dataStr, err := reader.ReadString(DataDelimiterByte)
-	for !errors.Is(err, io.EOF) {
+	defer f.Close()
+	var offset int64 = FHeaderSize // 当前文件读取位置
+	if from > offset {
+		if _, err = f.Seek(from, io.SeekStart); err != nil {
+			slogger.Fatalf("seek f: %s offset: %d error: %v", segPath, from, err)
+		}
+		reader.Reset(f)
+		offset = from
+	}
+	idx := make(fileIdx)
+	_, err = engine.scanSegF(reader, offset, func(seg *Segment) error {
+		idx.put(segment2MemIndex(seg, path.Base(segPath)))
+		return nil
+	})
+	if err != nil {
+		slogger.Fatalf("read active segment error: %v", err)
+	}
+	return idx
+}
+
+// scanSegF 从reader当前位置(文件中的offset位置)开始逐条读取段文件记录，对每条生效的记录调用fn，返回最后一条生效记录的结束位置
+// 批量写入的记录在读到其后的提交记录时才生效，没有提交记录的批量写入(写入中断导致)被丢弃；长度不足(按头部中的keysz、valsz)的记录一定是残缺记录
+func (engine *DBEngine) scanSegF(reader *bufio.Reader, offset int64, fn func(seg *Segment) error) (int64, error) {
+	validSize := offset
+	batch := make([]*Segment, 0)
+	for {
+		dataStr, err := readSeg(reader)
+		if errors.Is(err, io.EOF) {
+			return validSize, nil
+		}
 		if err != nil {
-			slogger.Fatalf("read active segment error: %v", err)
+			return validSize, err
 		}
 		offset = offset + int64(len(dataStr))
-		seg, err1 := decodeSeg(dataStr)
-		if err1 != nil {
-			slogger.Error(err1)
-		} else {
-			// 更新索引
-			seg.valops = offset - int64(NewLineSize+seg.valsz)
-			engine.updMemIdx(segment2MemIndex(seg, path.Base(segPath)))
+		seg, err := decodeSeg(dataStr, engine.crypt)
+		if err != nil {
+			slogger.Error(err)
+			continue
 		}
-		dataStr, err = reader.ReadString(DataDelimiterByte)
+		seg.valops = offset - int64(NewLineSize+seg.valsz)
+		applied := []*Segment{seg}
+		switch {
+		case seg.seq == 0:
+			// 段合并原样复制的操作数链中的记录，只能通过操作数记录中的指针读取
+			applied = nil
+		case seg.kind&FlagBatch != 0:
+			seg.kind &^= FlagBatch
+			batch = append(batch, seg)
+			continue
+		case seg.kind == KindCommit:
+			applied = batch
+			if seg.value != strconv.Itoa(len(batch)) {
+				slogger.Errorf("batch commit record: %s, record num: %d mismatch, discard batch", seg.value, len(batch))
+				applied = nil
+			}
+			batch = make([]*Segment, 0)
+		case len(batch) > 0:
+			slogger.Errorf("discard uncommitted batch, record num: %d", len(batch))
+			batch = make([]*Segment, 0)
+		}
+		if fn != nil {
+			for _, s := range applied {
+				if err = fn(s); err != nil {
+					return validSize, err
+				}
+			}
+		}
+		validSize = offset
 	}
 }
 
@@ -228,11 +689,16 @@ func (engine *DBEngine) prsSegF(segPath string) {
 func (engine *DBEngine) newDataF(fNameFormat, fNamePrefix string, fTm int64) (string, error) {
 	fName := fmt.Sprintf(fNameFormat, fNamePrefix, fTm)
 	fPath := path.Join(engine.dataDir, fName)
-	f, err := os.Create(fPath)
+	// 文件名称已存在时返回错误，不覆盖已有的数据文件
+	f, err := os.OpenFile(fPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, FileMode)
 	if err != nil {
 		return "", fmt.Errorf("create segmentFile error, fPath: %s, error: %v", fPath, err)
 	}
 	defer f.Close()
+	// 写入文件头
+	if _, err = f.WriteString(encodeFHeader(fMagic(fNamePrefix))); err != nil {
+		return "", fmt.Errorf("write file header error, fPath: %s, error: %v", fPath, err)
+	}
 	return fName, nil
 }
 
@@ -251,22 +717,69 @@ func (engine *DBEngine) newCompF() (string, string, error) {
 }
 
 // genMemIdx 通过hint file 生成 memory memIdx
-func (engine *DBEngine) genMemIdx(segFs []os.DirEntry) {
-	for _, f := range segFs {
-		// 如果有hint file,就使用hint file 生成index
-		hintFName, err := compFName(f.Name(), SegFNamePrefix)
-		if err != nil {
-			slogger.Fatalf("company file error:%v", err)
+// 由IdxWorkerNum个goroutine并发解析各个段文件(或其hint文件)，解析结果按照序列号规则合并后写入内存索引；
+// 合并过程中保留删除记录，保证较旧段文件中的数据不会覆盖较新段文件中的删除记录
+func (engine *DBEngine) genMemIdx(segFs []string) {
+	segFCh := make(chan string)
+	idxCh := make(chan fileIdx)
+	workerNum := IdxWorkerNum
+	if len(segFs) < workerNum {
+		workerNum = len(segFs)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workerNum; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for segFName := range segFCh {
+				idxCh <- engine.loadSegIdx(segFName)
+			}
+		}()
+	}
+	go func() {
+		for _, segFName := range segFs {
+			segFCh <- segFName
+		}
+		close(segFCh)
+		wg.Wait()
+		close(idxCh)
+	}()
+	merged := make(fileIdx)
+	for idx := range idxCh {
+		for k, v := range idx {
+			merged.put(&MemIdx{idxK: k, idxV: v})
 		}
-		hintPath := path.Join(engine.dataDir, hintFName)
-		if isExistF(hintPath) {
-			engine.prsHintF(hintPath)
+	}
+	engine.applyFileIdx(merged)
+}
+
+// applyFileIdx 将合并后的文件索引写入内存索引，并推进当前序列号
+func (engine *DBEngine) applyFileIdx(merged fileIdx) {
+	for k, v := range merged {
+		engine.updMemIdx(&MemIdx{idxK: k, idxV: v})
+	}
+	if seq := merged.maxSeq(); seq > engine.seq {
+		engine.seq = seq
+	}
+}
+
+// loadSegIdx 生成单个段文件的索引：若段文件有hint file,就使用hint file 生成索引，否则扫描整个段文件
+func (engine *DBEngine) loadSegIdx(segFName string) fileIdx {
+	hintFName, err := compFName(segFName, SegFNamePrefix)
+	if err != nil {
+		slogger.Fatalf("company file error:%v", err)
+	}
+	hintPath := path.Join(engine.dataDir, hintFName)
+	if engine.isExistCompF(segFName, SegFNamePrefix) {
+		idx, err := engine.prsHintF(hintPath)
+		if err == nil {
 			slogger.Infof("parse hint file: %s done.\n", hintPath)
-		} else {
-			// 否则，就扫描整个段文件生成index
-			segPath := path.Join(engine.dataDir, f.Name())
-			engine.prsSegF(segPath)
-			slogger.Infof("parse segment file: %s done.\n", segPath)
+			return idx
 		}
+		slogger.Errorf("parse hint file: %s error, fall back to scan segment file: %v", hintPath, err)
 	}
+	segPath := path.Join(engine.dataDir, segFName)
+	idx := engine.prsSegF(segPath, 0)
+	slogger.Infof("parse segment file: %s done.\n", segPath)
+	return idx
 }
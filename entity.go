@@ -2,9 +2,13 @@ package xdb
 
 // val 内嵌最小共用字段
 type val struct {
-	valsz  int   // 值长度
-	valops int64 // 值在文件中的位置
-	tm     int64 // 时间戳
+	valsz  int    // 值长度
+	valops int64  // 值在文件中的位置
+	tm     int64  // 时间戳，仅作为元数据，不参与新旧判断
+	seq    uint64 // 序列号，单调递增，用于判断数据新旧
+	kind   uint8  // 记录类型：KindVal、KindBlob
+	codec  uint8  // value 的压缩编解码器标识
+	keyID  uint32 // 加密密钥标识，0 表示未加密
 }
 
 // MemIdxV 表示内存索引
@@ -0,0 +1,13 @@
+package xdb
+
+import "errors"
+
+var (
+	ErrLocked             = errors.New("data dir is locked by another process")        // 数据目录已被其他进程打开
+	ErrUnsupportedVersion = errors.New("unsupported data file format version")         // 数据文件格式版本号高于当前引擎支持的版本
+	ErrSnapshotReleased   = errors.New("snapshot released")                            // 快照已释放
+	ErrConflict           = errors.New("transaction conflict")                         // 事务读取的key在提交前被其他写入修改
+	ErrChangesCompacted   = errors.New("changes compacted")                            // 请求的变化已被段合并丢弃
+	ErrTxnDone            = errors.New("transaction already committed or rolled back") // 事务已提交或回滚
+	ErrClosed             = errors.New("db closed")                                    // 数据库未打开或已关闭
+)
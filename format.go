@@ -0,0 +1,227 @@
+package xdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// 数据文件格式版本
+// 段文件和hint文件以文件头(magic+格式版本号，格式：FHeaderFormat)开始，之后为数据记录；
+// 版本0为没有文件头的旧格式：段文件记录不包含seq、kind、codec、keyID，hint文件记录不包含CRC校验值
+// 引擎启动时拒绝打开版本号高于FormatVersion的数据文件，并将旧版本的数据文件迁移为当前格式
+
+// fMagic 获取数据文件名称前缀对应的文件头magic
+func fMagic(prefix string) string {
+	switch prefix {
+	case HintFNamePrefix:
+		return HintFMagic
+	case BlobFNamePrefix:
+		return BlobFMagic
+	}
+	return SegFMagic
+}
+
+// encodeFHeader 生成数据文件头
+func encodeFHeader(magic string) string {
+	return fmt.Sprintf(FHeaderFormat, magic, FormatVersion)
+}
+
+// readFHeader 读取并跳过数据文件头，返回文件格式版本号
+// 没有文件头(包括空文件)的旧格式文件返回版本0，且不消耗reader中的数据
+func readFHeader(reader *bufio.Reader, magic string) (int, error) {
+	buf, _ := reader.Peek(FHeaderSize)
+	if len(buf) < FHeaderSize {
+		return 0, nil
+	}
+	if !strings.HasPrefix(string(buf), magic) {
+		// 旧格式的记录以16进制CRC校验值开头
+		if strings.ContainsRune("0123456789abcdef", rune(buf[0])) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%w: unknown file header: %q", ErrUnsupportedVersion, buf)
+	}
+	var version int
+	if _, err := fmt.Sscanf(string(buf[len(magic):]), "%04x\n", &version); err != nil {
+		return 0, fmt.Errorf("bad file header: %q error: %v", buf, err)
+	}
+	if version > FormatVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	reader.Discard(FHeaderSize)
+	return version, nil
+}
+
+// openDataF 打开数据文件并跳过文件头，返回的reader从第一条记录开始读取；数据文件必须为当前格式
+func openDataF(fPath, magic string) (*os.File, *bufio.Reader, error) {
+	f, err := os.OpenFile(fPath, os.O_RDONLY, FileMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open file: %s error: %v", fPath, err)
+	}
+	reader := bufio.NewReader(f)
+	version, err := readFHeader(reader, magic)
+	if err == nil && version != FormatVersion {
+		err = fmt.Errorf("%w: %d, migration required", ErrUnsupportedVersion, version)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("file: %s error: %w", fPath, err)
+	}
+	return f, reader, nil
+}
+
+// fVersion 获取数据文件格式版本号
+func fVersion(fPath, magic string) (int, error) {
+	f, err := os.OpenFile(fPath, os.O_RDONLY, FileMode)
+	if err != nil {
+		return 0, fmt.Errorf("open file: %s error: %v", fPath, err)
+	}
+	defer f.Close()
+	version, err := readFHeader(bufio.NewReader(f), magic)
+	if err != nil {
+		return 0, fmt.Errorf("file: %s error: %w", fPath, err)
+	}
+	return version, nil
+}
+
+// Migrate 将数据目录下旧版本的段文件和hint文件迁移为当前格式；Open 时也会自动迁移，该方法用于在离线状态下提前完成迁移
+// 数据目录已被其他进程打开时返回ErrLocked
+func Migrate(dataDir string) error {
+	lockF, err := lockDir(dataDir)
+	if err != nil {
+		return err
+	}
+	defer unlockDir(lockF)
+	m, err := openManifest(dataDir)
+	if err != nil {
+		return fmt.Errorf("open manifest error: %v", err)
+	}
+	defer m.close()
+	engine := &DBEngine{dataDir: dataDir, manifest: m}
+	return engine.migrate()
+}
+
+// migrate 检查所有有效数据文件的格式版本，将旧版本的段文件重写为当前格式，并删除旧版本的hint文件
+// 版本0的记录没有序列号，迁移时使用记录的时间戳作为序列号，保持旧格式按时间戳判断数据新旧的语义
+// hint 文件中的valops随段文件格式变化而失效，删除后由引擎扫描段文件生成索引，并在关闭时重新生成hint文件
+// 迁移过程不需要解密数据，加密的key按原样保存
+func (engine *DBEngine) migrate() error {
+	legacyHints := make([]string, 0)
+	migrated := 0
+	for _, prefix := range []string{SegFNamePrefix, HintFNamePrefix, BlobFNamePrefix} {
+		for _, fName := range engine.manifest.liveFs(prefix) {
+			version, err := fVersion(path.Join(engine.dataDir, fName), fMagic(prefix))
+			if err != nil {
+				return err
+			}
+			if version == FormatVersion {
+				continue
+			}
+			switch prefix {
+			case HintFNamePrefix:
+				legacyHints = append(legacyHints, fName)
+			case SegFNamePrefix:
+				if err = engine.migrateSegF(fName); err != nil {
+					return err
+				}
+				migrated++
+			default:
+				return fmt.Errorf("%w: blob file: %s version: %d", ErrUnsupportedVersion, fName, version)
+			}
+		}
+	}
+	if len(legacyHints) > 0 {
+		if err := engine.manifest.commit(nil, legacyHints); err != nil {
+			return fmt.Errorf("remove hint files from manifest error: %v", err)
+		}
+		for _, hintFName := range legacyHints {
+			if err := os.Remove(path.Join(engine.dataDir, hintFName)); err != nil {
+				slogger.Errorf("delete hint file: %s error: %v", hintFName, err)
+			}
+		}
+		migrated += len(legacyHints)
+	}
+	if migrated == 0 {
+		return nil
+	}
+	// 内存索引快照中的valops已失效
+	if err := os.Remove(path.Join(engine.dataDir, IdxSnapFName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove index snapshot error: %v", err)
+	}
+	slogger.Infof("migrate data dir: %s to format version: %d done, file num: %d\n", engine.dataDir, FormatVersion, migrated)
+	return nil
+}
+
+// migrateSegF 将版本0的段文件重写到临时文件，刷盘后rename替换原文件；无法解析的记录(残缺记录)被丢弃
+func (engine *DBEngine) migrateSegF(segFName string) error {
+	segPath := path.Join(engine.dataDir, segFName)
+	f, err := os.OpenFile(segPath, os.O_RDONLY, FileMode)
+	if err != nil {
+		return fmt.Errorf("open segment file: %s error: %v", segPath, err)
+	}
+	defer f.Close()
+	tmpPath := path.Join(engine.dataDir, MigrateFNamePrefix+Delimiter+segFName)
+	tmpF, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, FileMode)
+	if err != nil {
+		return fmt.Errorf("create file: %s error: %v", tmpPath, err)
+	}
+	defer tmpF.Close()
+	writer := bufio.NewWriter(tmpF)
+	writer.WriteString(encodeFHeader(SegFMagic))
+	reader := bufio.NewReader(f)
+	dataStr, err := reader.ReadString(DataDelimiterByte)
+	for !errors.Is(err, io.EOF) {
+		if err != nil {
+			return fmt.Errorf("read segment file: %s error: %v", segPath, err)
+		}
+		seg, err1 := decodeLegacySeg(dataStr)
+		if err1 != nil {
+			slogger.Errorf("migrate segment file: %s discard record error: %v", segPath, err1)
+		} else {
+			segStr, err := encodeSegRaw(seg, seg.key)
+			if err != nil {
+				return fmt.Errorf("encode seg key: %s error: %v", seg.key, err)
+			}
+			writer.WriteString(segStr)
+		}
+		dataStr, err = reader.ReadString(DataDelimiterByte)
+	}
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("write file: %s error: %v", tmpPath, err)
+	}
+	if err = tmpF.Sync(); err != nil {
+		return fmt.Errorf("sync file: %s error: %v", tmpPath, err)
+	}
+	if err = os.Rename(tmpPath, segPath); err != nil {
+		return fmt.Errorf("rename file: %s error: %v", tmpPath, err)
+	}
+	syncDir(engine.dataDir)
+	slogger.Infof("migrate segment file: %s done.\n", segFName)
+	return nil
+}
+
+// decodeLegacySeg 解析版本0的段文件记录，使用记录的时间戳作为序列号
+func decodeLegacySeg(data string) (*Segment, error) {
+	seg := &Segment{}
+	var segKV, keyAndValue string
+	if _, err := fmt.Sscanf(data, CRCFormat, &seg.crcVal, &segKV); err != nil {
+		return nil, fmt.Errorf("decode legacy seg data: %s error: %v", data, err)
+	}
+	if !checkCRC(segKV, seg.crcVal) {
+		return nil, fmt.Errorf("crc broken,data: %s,crc: %d", segKV, seg.crcVal)
+	}
+	if _, err := fmt.Sscanf(segKV, LegacySegFormatKV, &seg.tm, &seg.keysz, &seg.valsz, &keyAndValue); err != nil {
+		return nil, fmt.Errorf("segKV: %s error: %v", segKV, err)
+	}
+	if seg.keysz > len(keyAndValue) {
+		return nil, fmt.Errorf("segKV: %s bad keysz: %d", segKV, seg.keysz)
+	}
+	seg.key = keyAndValue[:seg.keysz]
+	seg.value = keyAndValue[seg.keysz:]
+	seg.seq = uint64(seg.tm)
+	return seg, nil
+}
@@ -2,8 +2,9 @@ module github.com/CatchTheDog/xdb
 
 go 1.19
 
+require go.uber.org/zap v1.23.0
+
 require (
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	go.uber.org/zap v1.23.0 // indirect
 )
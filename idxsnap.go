@@ -0,0 +1,244 @@
+package xdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// idxSnap 内存索引快照，记录快照时刻的完整内存索引，以及快照覆盖的段文件及其长度
+// 引擎启动时加载快照，只需回放快照之后写入的数据：快照之后新建的段文件，以及段文件中超出覆盖长度的部分
+type idxSnap struct {
+	seq    uint64             // 快照时刻的最大序列号
+	files  []snapF            // 快照覆盖的段文件
+	memIdx map[string]MemIdxV // 内存索引
+}
+
+// snapF 快照覆盖的段文件
+type snapF struct {
+	fName string // 段文件名称
+	size  int64  // 快照时刻段文件的长度
+}
+
+// captureIdxSnap 生成内存索引快照，调用方需持有segMergeMu和segFMu，保证快照期间没有写入和段合并
+func (engine *DBEngine) captureIdxSnap() *idxSnap {
+	snap := &idxSnap{
+		seq:    engine.seq,
+		files:  make([]snapF, 0),
+		memIdx: make(map[string]MemIdxV, len(engine.memIdx)),
+	}
+	for _, segFName := range engine.manifest.liveFs(SegFNamePrefix) {
+		snap.files = append(snap.files, snapF{fName: segFName, size: engine.segFLen(segFName)})
+	}
+	engine.memIdxMu.RLock()
+	defer engine.memIdxMu.RUnlock()
+	for k, v := range engine.memIdx {
+		snap.memIdx[k] = v
+	}
+	return snap
+}
+
+// checkpoint 每隔CheckpointInterval保存一次内存索引快照，直到引擎关闭
+func (engine *DBEngine) checkpoint() {
+	defer engine.bgWg.Done()
+	ticker := time.NewTicker(CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-engine.stopCh:
+			return
+		case <-ticker.C:
+			engine.segMergeMu.Lock()
+			engine.segFMu.Lock()
+			snap := engine.captureIdxSnap()
+			engine.segFMu.Unlock()
+			engine.segMergeMu.Unlock()
+			if err := engine.saveIdxSnap(snap); err != nil {
+				slogger.Errorf("save index snapshot error: %v", err)
+			}
+		}
+	}
+}
+
+// saveIdxSnap 将内存索引快照写入临时文件，然后rename替换快照文件
+// 快照文件格式(大端序)：
+//
+//	magic(4B) | seq(8B) | 段文件数(4B) | [名称长度(2B) 名称 长度(8B)]... |
+//	索引项数(8B) | [key长度(2B) key 段文件序号(4B) valsz(4B) valops(8B) tm(8B) seq(8B) kind(1B) codec(1B) keyID(4B)]... | crc32(4B)
+//
+// 若索引项已加密(keyID不为0)，key与段文件中一样使用对应密钥加密后保存
+func (engine *DBEngine) saveIdxSnap(snap *idxSnap) error {
+	tmpPath := path.Join(engine.dataDir, IdxSnapTmpFName)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, FileMode)
+	if err != nil {
+		return fmt.Errorf("create index snapshot: %s error: %v", tmpPath, err)
+	}
+	defer f.Close()
+	hash := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, hash))
+	fIDs := make(map[string]uint32, len(snap.files))
+	w.WriteString(IdxSnapMagic)
+	binary.Write(w, binary.BigEndian, snap.seq)
+	binary.Write(w, binary.BigEndian, uint32(len(snap.files)))
+	for i, file := range snap.files {
+		fIDs[file.fName] = uint32(i)
+		binary.Write(w, binary.BigEndian, uint16(len(file.fName)))
+		w.WriteString(file.fName)
+		binary.Write(w, binary.BigEndian, file.size)
+	}
+	binary.Write(w, binary.BigEndian, uint64(len(snap.memIdx)))
+	for k, v := range snap.memIdx {
+		storedKey, err := engine.crypt.sealKey(v.keyID, k)
+		if err != nil {
+			return fmt.Errorf("encrypt index snapshot key error: %v", err)
+		}
+		binary.Write(w, binary.BigEndian, uint16(len(storedKey)))
+		w.WriteString(storedKey)
+		binary.Write(w, binary.BigEndian, fIDs[v.fName])
+		binary.Write(w, binary.BigEndian, uint32(v.valsz))
+		binary.Write(w, binary.BigEndian, v.valops)
+		binary.Write(w, binary.BigEndian, v.tm)
+		binary.Write(w, binary.BigEndian, v.seq)
+		w.WriteByte(v.kind)
+		w.WriteByte(v.codec)
+		binary.Write(w, binary.BigEndian, v.keyID)
+	}
+	if err = w.Flush(); err != nil {
+		return fmt.Errorf("write index snapshot: %s error: %v", tmpPath, err)
+	}
+	if err = binary.Write(f, binary.BigEndian, hash.Sum32()); err != nil {
+		return fmt.Errorf("write index snapshot: %s error: %v", tmpPath, err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("sync index snapshot: %s error: %v", tmpPath, err)
+	}
+	fPath := path.Join(engine.dataDir, IdxSnapFName)
+	if err = os.Rename(tmpPath, fPath); err != nil {
+		return fmt.Errorf("rename index snapshot: %s error: %v", tmpPath, err)
+	}
+	syncDir(engine.dataDir)
+	slogger.Infof("save index snapshot done, key num: %d, segment file num: %d\n", len(snap.memIdx), len(snap.files))
+	return nil
+}
+
+// loadIdxSnap 加载并校验内存索引快照；快照文件不存在时返回nil
+func (engine *DBEngine) loadIdxSnap() (*idxSnap, error) {
+	fPath := path.Join(engine.dataDir, IdxSnapFName)
+	if !isExistF(fPath) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fPath)
+	if err != nil {
+		return nil, fmt.Errorf("read index snapshot: %s error: %v", fPath, err)
+	}
+	if len(data) < len(IdxSnapMagic)+crc32.Size || string(data[:len(IdxSnapMagic)]) != IdxSnapMagic {
+		return nil, fmt.Errorf("index snapshot: %s bad header", fPath)
+	}
+	body := data[:len(data)-crc32.Size]
+	if !checkCRC(string(body), binary.BigEndian.Uint32(data[len(body):])) {
+		return nil, fmt.Errorf("index snapshot: %s crc broken", fPath)
+	}
+	r := bytes.NewReader(body[len(IdxSnapMagic):])
+	var seq uint64
+	var fNum uint32
+	for _, field := range []interface{}{&seq, &fNum} {
+		if err = binary.Read(r, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("index snapshot: %s decode error: %v", fPath, err)
+		}
+	}
+	snap := &idxSnap{seq: seq, files: make([]snapF, fNum)}
+	for i := range snap.files {
+		name, err := readSnapStr(r)
+		if err != nil {
+			return nil, fmt.Errorf("index snapshot: %s decode error: %v", fPath, err)
+		}
+		snap.files[i].fName = name
+		if err = binary.Read(r, binary.BigEndian, &snap.files[i].size); err != nil {
+			return nil, fmt.Errorf("index snapshot: %s decode error: %v", fPath, err)
+		}
+	}
+	var keyNum uint64
+	if err = binary.Read(r, binary.BigEndian, &keyNum); err != nil {
+		return nil, fmt.Errorf("index snapshot: %s decode error: %v", fPath, err)
+	}
+	snap.memIdx = make(map[string]MemIdxV, keyNum)
+	for i := uint64(0); i < keyNum; i++ {
+		key, err := readSnapStr(r)
+		if err != nil {
+			return nil, fmt.Errorf("index snapshot: %s decode error: %v", fPath, err)
+		}
+		var fID, valsz uint32
+		idxV := MemIdxV{}
+		for _, field := range []interface{}{&fID, &valsz, &idxV.valops, &idxV.tm, &idxV.seq, &idxV.kind, &idxV.codec, &idxV.keyID} {
+			if err = binary.Read(r, binary.BigEndian, field); err != nil {
+				return nil, fmt.Errorf("index snapshot: %s decode error: %v", fPath, err)
+			}
+		}
+		if fID >= fNum {
+			return nil, fmt.Errorf("index snapshot: %s bad segment file id: %d", fPath, fID)
+		}
+		if key, err = engine.crypt.openKey(idxV.keyID, key); err != nil {
+			return nil, fmt.Errorf("index snapshot: %s decrypt key error: %v", fPath, err)
+		}
+		idxV.fName = snap.files[fID].fName
+		idxV.valsz = int(valsz)
+		snap.memIdx[key] = idxV
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("index snapshot: %s has %d trailing bytes", fPath, r.Len())
+	}
+	return snap, nil
+}
+
+// readSnapStr 读取快照中以2字节长度为前缀的字符串
+func readSnapStr(r *bytes.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// restoreIdxSnap 使用内存索引快照恢复内存索引，并回放快照之后写入的数据
+// 若快照覆盖的段文件已不再有效(已被合并)或长度小于快照记录的长度，则快照失效，返回false
+func (engine *DBEngine) restoreIdxSnap(snap *idxSnap, segFs []string) bool {
+	covered := make(map[string]int64, len(snap.files))
+	for _, file := range snap.files {
+		if !engine.manifest.isLive(file.fName) || engine.segFLen(file.fName) < file.size {
+			slogger.Infof("index snapshot is out of date, segment file: %s\n", file.fName)
+			return false
+		}
+		covered[file.fName] = file.size
+	}
+	engine.memIdx = snap.memIdx
+	engine.seq = snap.seq
+	merged := make(fileIdx)
+	for _, segFName := range segFs {
+		var idx fileIdx
+		size, ok := covered[segFName]
+		switch {
+		case !ok:
+			idx = engine.loadSegIdx(segFName)
+		case engine.segFLen(segFName) > size:
+			idx = engine.prsSegF(path.Join(engine.dataDir, segFName), size)
+		default:
+			continue
+		}
+		for k, v := range idx {
+			merged.put(&MemIdx{idxK: k, idxV: v})
+		}
+	}
+	engine.applyFileIdx(merged)
+	slogger.Infof("restore index snapshot done, key num: %d, replay key num: %d\n", len(engine.memIdx), len(merged))
+	return true
+}
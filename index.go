@@ -0,0 +1,222 @@
+package xdb
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 二级索引：通过Options.Indexes为桶注册索引函数，索引函数从(key,value)中提取索引词；每个索引词在引擎内部保存为一个索引项key：
+// IndexKeyPrefix+索引名称+BucketKeyPrefix+索引词(16进制编码)+BucketKeyPrefix+key
+// 桶中key的写入/删除与索引项的增删通过一个批量写入原子地完成；索引项与普通记录一样持久化，
+// 引擎启动时对尚未构建完成(不存在索引构建完成记录)的索引扫描桶中的全部key进行构建
+
+// IndexFunc 索引函数，返回(key,value)的索引词列表
+type IndexFunc func(key, value []byte) [][]byte
+
+// secIndex 二级索引
+type secIndex struct {
+	name   string    // 索引名称
+	bucket string    // 桶名称
+	fn     IndexFunc // 索引函数
+}
+
+// Index 二级索引配置
+type Index struct {
+	Bucket string    // 桶名称
+	Name   string    // 索引名称，在同一个引擎中唯一
+	Fn     IndexFunc // 索引函数
+}
+
+// newSecIdxs 按Options.Indexes注册二级索引；修改索引函数后需要调用DropIndex，之后的Open按新的索引函数重新构建索引
+func newSecIdxs(indexes []Index) (map[string]*secIndex, error) {
+	secIdxs := make(map[string]*secIndex)
+	for _, idx := range indexes {
+		if idx.Name == "" || strings.Contains(idx.Name, BucketKeyPrefix) || idx.Fn == nil {
+			return nil, fmt.Errorf("bad index name: %q or index func", idx.Name)
+		}
+		if _, err := Bucket(idx.Bucket); err != nil {
+			return nil, err
+		}
+		if _, ok := secIdxs[idx.Name]; ok {
+			return nil, fmt.Errorf("index: %s already registered", idx.Name)
+		}
+		secIdxs[idx.Name] = &secIndex{name: idx.Name, bucket: idx.Bucket, fn: idx.Fn}
+	}
+	return secIdxs, nil
+}
+
+// indexesOf 按名称排序返回桶上注册的二级索引；bucket为空时返回全部二级索引
+func (engine *DBEngine) indexesOf(bucket string) []*secIndex {
+	idxs := make([]*secIndex, 0)
+	if engine == nil {
+		return idxs
+	}
+	for _, idx := range engine.secIdxs {
+		if bucket == "" || idx.bucket == bucket {
+			idxs = append(idxs, idx)
+		}
+	}
+	sort.Slice(idxs, func(i, j int) bool { return idxs[i].name < idxs[j].name })
+	return idxs
+}
+
+// indexPrefix 获取索引中全部索引项key的内部前缀
+func indexPrefix(name string) string {
+	return IndexKeyPrefix + name + BucketKeyPrefix
+}
+
+// indexTermPrefix 获取索引中索引词为term的索引项key的内部前缀
+func indexTermPrefix(name string, term []byte) string {
+	return indexPrefix(name) + hex.EncodeToString(term) + BucketKeyPrefix
+}
+
+// indexBuiltKey 获取索引构建完成记录的key
+func indexBuiltKey(name string) string {
+	return IndexKeyPrefix + name
+}
+
+// entries 获取(key,value)在索引中的索引项key，value为nil时返回空集合
+func (idx *secIndex) entries(key string, value *string) (map[string]bool, error) {
+	entries := make(map[string]bool)
+	if value == nil {
+		return entries, nil
+	}
+	for _, term := range idx.fn([]byte(key), []byte(*value)) {
+		entry := indexTermPrefix(idx.name, term) + key
+		if len(entry) > MaxKeySize {
+			return nil, fmt.Errorf("index: %s, idxK: %s, index entry size: %d exceeds limit: %d", idx.name, key, len(entry), MaxKeySize)
+		}
+		entries[entry] = true
+	}
+	return entries, nil
+}
+
+// LookupIndex 按字典序返回索引中索引词为term的桶中的key
+func LookupIndex(name string, term []byte) ([]string, error) {
+	if err := dbEngine.checkOpen(); err != nil {
+		return nil, err
+	}
+	if _, ok := dbEngine.secIdxs[name]; !ok {
+		return nil, fmt.Errorf("index: %s not registered", name)
+	}
+	return dbEngine.groupKeys(indexTermPrefix(name, term)), nil
+}
+
+// DropIndex 删除索引中的全部索引项和索引构建完成记录，下一次Open时重新构建
+func DropIndex(name string) error {
+	if name == "" || strings.Contains(name, BucketKeyPrefix) {
+		return fmt.Errorf("bad index name: %q", name)
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	return dbEngine.dropPrefixes([]string{indexPrefix(name)}, []string{indexBuiltKey(name)})
+}
+
+// indexedWrite 持有段文件锁，读取key当前的value计算索引项的变化，将key的写入(value为nil表示删除)与索引项的增删作为一个批量写入
+func (engine *DBEngine) indexedWrite(b *DBBucket, idxs []*secIndex, key string, value *string) error {
+	keyID, err := engine.crypt.currentKeyID()
+	if err != nil {
+		return err
+	}
+	tm := time.Now().UnixNano()
+	seg := &Segment{Hint: Hint{key: b.prefix + key, keysz: len(b.prefix + key), val: val{tm: tm, keyID: keyID}}}
+	if value != nil {
+		stored, codecID, valKeyID, err := engine.encodeVal(seg.key, *value)
+		if err != nil {
+			return err
+		}
+		seg.value, seg.valsz, seg.codec, seg.keyID = stored, len(stored), codecID, valKeyID
+	}
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	var old *string
+	if indexValue, ok := engine.getMemIdx(seg.key); ok {
+		cur, err := engine.seekKey(seg.key, indexValue)
+		if err != nil {
+			return fmt.Errorf("idxK: %s, read value error: %v", key, err)
+		}
+		old = &cur
+	}
+	segs := []*Segment{seg}
+	for _, idx := range idxs {
+		oldEntries, err := idx.entries(key, old)
+		if err != nil {
+			return err
+		}
+		newEntries, err := idx.entries(key, value)
+		if err != nil {
+			return err
+		}
+		changed := make([]string, 0)
+		for entry := range oldEntries {
+			if !newEntries[entry] {
+				changed = append(changed, entry)
+			}
+		}
+		for entry := range newEntries {
+			if !oldEntries[entry] {
+				changed = append(changed, entry)
+			}
+		}
+		sort.Strings(changed)
+		for _, entry := range changed {
+			entrySeg := &Segment{Hint: Hint{key: entry, keysz: len(entry), val: val{tm: tm, keyID: keyID}}}
+			if newEntries[entry] {
+				entryVal, entryCodec, entryKeyID, err := engine.encodeVal(entry, IndexEntryValue)
+				if err != nil {
+					return err
+				}
+				entrySeg.value, entrySeg.valsz, entrySeg.codec, entrySeg.keyID = entryVal, len(entryVal), entryCodec, entryKeyID
+			}
+			segs = append(segs, entrySeg)
+		}
+	}
+	if err = engine.writeBatchLocked(segs); err != nil && !errors.Is(err, ErrClosed) {
+		slogger.Fatalf("write seg to file: %s error: %v", engine.segFName, err)
+	}
+	return err
+}
+
+// buildIndexes 引擎启动时构建尚未构建完成的二级索引：扫描桶中的全部key写入索引项，最后写入索引构建完成记录
+// 构建中断时下一次启动重新构建，重复写入的索引项与已有的索引项相同
+func (engine *DBEngine) buildIndexes() error {
+	for _, idx := range engine.indexesOf("") {
+		if _, ok := engine.getMemIdx(indexBuiltKey(idx.name)); ok {
+			continue
+		}
+		b, err := Bucket(idx.bucket)
+		if err != nil {
+			return err
+		}
+		keys := engine.groupKeys(b.prefix)
+		for _, key := range keys {
+			indexValue, ok := engine.getMemIdx(b.prefix + key)
+			if !ok {
+				continue
+			}
+			value, err := engine.seekKey(b.prefix+key, indexValue)
+			if err != nil {
+				return fmt.Errorf("idxK: %s, read value error: %v", key, err)
+			}
+			entries, err := idx.entries(key, &value)
+			if err != nil {
+				return err
+			}
+			for entry := range entries {
+				if err = engine.putInternal(entry, IndexEntryValue); err != nil {
+					return err
+				}
+			}
+		}
+		if err = engine.putInternal(indexBuiltKey(idx.name), IndexEntryValue); err != nil {
+			return err
+		}
+		slogger.Infof("build index: %s done, key num: %d\n", idx.name, len(keys))
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package xdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockDir 对数据目录下的LOCK文件加排他锁(flock)，防止多个进程同时打开同一个数据目录；锁已被占用时返回ErrLocked
+func lockDir(dir string) (*os.File, error) {
+	fPath := path.Join(dir, LockFName)
+	f, err := os.OpenFile(fPath, os.O_CREATE|os.O_RDWR, FileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %s error: %v", fPath, err)
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("lock file: %s error: %v", fPath, err)
+	}
+	return f, nil
+}
+
+// unlockDir 释放数据目录锁
+func unlockDir(f *os.File) error {
+	defer f.Close()
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
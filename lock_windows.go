@@ -0,0 +1,25 @@
+//go:build windows
+
+package xdb
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// lockDir windows 下不支持flock，仅创建LOCK文件，不提供进程间互斥
+func lockDir(dir string) (*os.File, error) {
+	fPath := path.Join(dir, LockFName)
+	f, err := os.OpenFile(fPath, os.O_CREATE|os.O_RDWR, FileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %s error: %v", fPath, err)
+	}
+	slogger.Warnf("data dir lock is not supported on windows, dir: %s", dir)
+	return f, nil
+}
+
+// unlockDir 释放数据目录锁
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
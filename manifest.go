@@ -0,0 +1,306 @@
+package xdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// manifest 维护MANIFEST文件，记录当前有效(live)的段文件和hint文件集合，是引擎启动时数据文件的唯一依据
+// MANIFEST 为append-only文件，每行为一条带CRC校验的变更记录，格式：%08x+seg_1,+hint_1,-seg_0,-hint_0,#seq,^seg_1:maxSeq,%cdcFloor\n
+// 段文件切换时记录当前的最大序列号(#seq)，保证引擎重启后序列号不会回退；生成hint文件(包括段合并)时记录段文件中的最大序列号(^)，
+// 段合并时记录被合并的记录中的最大序列号(%)，CDC据此判断变化是否已被丢弃
+// 记录条数达到ManifestRewriteLimit时，将当前有效文件集合重写为一条记录，通过临时文件+rename原子替换原文件
+type manifest struct {
+	dir     string              // 数据文件保存目录
+	f       *os.File            // MANIFEST 文件
+	live    map[string]struct{} // 当前有效的数据文件集合
+	records int                 // MANIFEST 中的记录条数
+	seq     uint64              // 已记录的最大序列号
+	maxSeqs map[string]uint64   // 已生成hint文件的有效段文件中记录的最大序列号
+	floor   uint64              // 已被段合并丢弃的记录中的最大序列号
+	mu      sync.Mutex          // MANIFEST 文件锁
+}
+
+// openManifest 加载数据目录下的MANIFEST文件；若MANIFEST不存在，则使用数据目录下现有的段文件和hint文件初始化
+func openManifest(dir string) (*manifest, error) {
+	m := &manifest{
+		dir:     dir,
+		live:    make(map[string]struct{}),
+		maxSeqs: make(map[string]uint64),
+	}
+	fPath := path.Join(dir, ManifestFName)
+	if isExistF(fPath) {
+		if err := m.load(fPath); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, prefix := range []string{SegFNamePrefix, HintFNamePrefix} {
+			for _, f := range getDataFs(dir, prefix, DESC) {
+				m.live[f.Name()] = struct{}{}
+			}
+		}
+		slogger.Infof("manifest not found, init from data dir: %s, live file num: %d\n", dir, len(m.live))
+	}
+	// 启动时重写MANIFEST，丢弃历史变更记录以及可能存在的残缺记录
+	if err := m.rewrite(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load 逐条回放MANIFEST中的变更记录；遇到校验失败的记录(写入中断导致的残缺记录)时，丢弃其后所有记录
+func (m *manifest) load(fPath string) error {
+	f, err := os.OpenFile(fPath, os.O_RDONLY, FileMode)
+	if err != nil {
+		return fmt.Errorf("open manifest: %s error: %v", fPath, err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	dataStr, err := reader.ReadString(DataDelimiterByte)
+	for !errors.Is(err, io.EOF) {
+		if err != nil {
+			return fmt.Errorf("read manifest: %s error: %v", fPath, err)
+		}
+		edit, err1 := decodeManifest(dataStr)
+		if err1 != nil {
+			slogger.Errorf("manifest: %s broken record, discard the rest: %v", fPath, err1)
+			break
+		}
+		m.apply(edit)
+		dataStr, err = reader.ReadString(DataDelimiterByte)
+	}
+	return nil
+}
+
+// manifestEdit MANIFEST中的一条变更记录
+type manifestEdit struct {
+	adds    []string          // 新增的文件
+	dels    []string          // 删除的文件
+	seq     uint64            // 当前的最大序列号，为0时不记录
+	maxSeqs map[string]uint64 // 段文件中记录的最大序列号
+	floor   uint64            // 被段合并丢弃的记录中的最大序列号，为0时不记录
+}
+
+// apply 将变更应用到有效文件集合
+func (m *manifest) apply(edit manifestEdit) {
+	if edit.seq > m.seq {
+		m.seq = edit.seq
+	}
+	if edit.floor > m.floor {
+		m.floor = edit.floor
+	}
+	for _, name := range edit.adds {
+		m.live[name] = struct{}{}
+	}
+	for name, seq := range edit.maxSeqs {
+		m.maxSeqs[name] = seq
+	}
+	for _, name := range edit.dels {
+		delete(m.live, name)
+		delete(m.maxSeqs, name)
+		// 删除hint文件(重新打开的活跃段文件追加写入)时，段文件中记录的最大序列号同时失效
+		if strings.HasPrefix(name, HintFNamePrefix) {
+			segFName, _ := compFName(name, HintFNamePrefix)
+			delete(m.maxSeqs, segFName)
+		}
+	}
+}
+
+// commit 原子地记录一次变更：新增adds中的文件，删除dels中的文件；记录刷盘后才会生效
+func (m *manifest) commit(adds, dels []string) error {
+	return m.commitEdit(manifestEdit{adds: adds, dels: dels})
+}
+
+// commitSeq 同commit，同时记录当前的最大序列号seq(为0时不记录)
+func (m *manifest) commitSeq(adds, dels []string, seq uint64) error {
+	return m.commitEdit(manifestEdit{adds: adds, dels: dels, seq: seq})
+}
+
+// commitEdit 原子地记录一次变更，记录刷盘后才会生效
+func (m *manifest) commitEdit(edit manifestEdit) error {
+	if len(edit.adds) == 0 && len(edit.dels) == 0 && edit.seq == 0 && len(edit.maxSeqs) == 0 && edit.floor == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.f.WriteString(encodeManifest(edit)); err != nil {
+		return fmt.Errorf("write manifest error: %v", err)
+	}
+	if err := m.f.Sync(); err != nil {
+		return fmt.Errorf("sync manifest error: %v", err)
+	}
+	m.apply(edit)
+	m.records++
+	if m.records >= ManifestRewriteLimit {
+		return m.rewrite()
+	}
+	return nil
+}
+
+// rewrite 将当前有效文件集合写入临时文件，然后rename替换MANIFEST
+func (m *manifest) rewrite() error {
+	tmpPath := path.Join(m.dir, ManifestTmpFName)
+	tmpF, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, FileMode)
+	if err != nil {
+		return fmt.Errorf("create manifest: %s error: %v", tmpPath, err)
+	}
+	records := 0
+	if len(m.live) > 0 || m.seq > 0 || m.floor > 0 {
+		edit := manifestEdit{adds: m.sortedLive(""), seq: m.seq, maxSeqs: m.maxSeqs, floor: m.floor}
+		if _, err = tmpF.WriteString(encodeManifest(edit)); err != nil {
+			tmpF.Close()
+			return fmt.Errorf("write manifest: %s error: %v", tmpPath, err)
+		}
+		records = 1
+	}
+	if err = tmpF.Sync(); err != nil {
+		tmpF.Close()
+		return fmt.Errorf("sync manifest: %s error: %v", tmpPath, err)
+	}
+	tmpF.Close()
+	fPath := path.Join(m.dir, ManifestFName)
+	if err = os.Rename(tmpPath, fPath); err != nil {
+		return fmt.Errorf("rename manifest: %s error: %v", tmpPath, err)
+	}
+	syncDir(m.dir)
+	if m.f != nil {
+		m.f.Close()
+	}
+	m.f, err = os.OpenFile(fPath, os.O_APPEND|os.O_WRONLY, FileMode)
+	if err != nil {
+		return fmt.Errorf("open manifest: %s error: %v", fPath, err)
+	}
+	m.records = records
+	return nil
+}
+
+// isLive 判断文件是否为有效文件
+func (m *manifest) isLive(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.live[name]
+	return ok
+}
+
+// liveFs 返回文件名称前缀匹配prefix的有效文件，并按照时间戳倒序排列
+func (m *manifest) liveFs(prefix string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedLive(prefix)
+}
+
+// sortedLive 同liveFs，调用方需持有m.mu或保证无并发访问
+func (m *manifest) sortedLive(prefix string) []string {
+	names := make([]string, 0)
+	for name := range m.live {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return sortFNames(names, DESC)
+}
+
+// close 关闭MANIFEST文件
+func (m *manifest) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.f == nil {
+		return nil
+	}
+	err := m.f.Close()
+	m.f = nil
+	return err
+}
+
+// maxSeq 获取段文件中记录的最大序列号，MANIFEST中没有记录(尚未生成hint文件)时返回false
+func (m *manifest) maxSeq(segFName string) (uint64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seq, ok := m.maxSeqs[segFName]
+	return seq, ok
+}
+
+// cdcFloor 获取已被段合并丢弃的记录中的最大序列号
+func (m *manifest) cdcFloor() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.floor
+}
+
+// encodeManifest 将一次变更编码为MANIFEST记录
+func encodeManifest(edit manifestEdit) string {
+	edits := make([]string, 0, len(edit.adds)+len(edit.dels)+len(edit.maxSeqs)+2)
+	for _, name := range edit.adds {
+		edits = append(edits, ManifestAdd+name)
+	}
+	for _, name := range edit.dels {
+		edits = append(edits, ManifestDel+name)
+	}
+	if edit.seq > 0 {
+		edits = append(edits, ManifestSeq+strconv.FormatUint(edit.seq, 16))
+	}
+	for _, name := range sortFNames(keysOf(edit.maxSeqs), DESC) {
+		edits = append(edits, ManifestMaxSeq+name+ManifestMaxSeqSep+strconv.FormatUint(edit.maxSeqs[name], 16))
+	}
+	if edit.floor > 0 {
+		edits = append(edits, ManifestCDCFloor+strconv.FormatUint(edit.floor, 16))
+	}
+	dataStr := strings.Join(edits, ManifestEditSep)
+	return fmt.Sprintf(CRCFormat, crc(dataStr), dataStr)
+}
+
+// keysOf 返回map中的全部key
+func keysOf(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// decodeManifest 解析MANIFEST记录
+func decodeManifest(data string) (manifestEdit, error) {
+	var checkSum uint32
+	var dataStr string
+	edit := manifestEdit{adds: make([]string, 0), dels: make([]string, 0), maxSeqs: make(map[string]uint64)}
+	_, err := fmt.Sscanf(data, CRCFormat, &checkSum, &dataStr)
+	if err != nil {
+		return edit, fmt.Errorf("decode manifest record: %q error: %v", data, err)
+	}
+	if !checkCRC(dataStr, checkSum) {
+		return edit, fmt.Errorf("crc broken, data: %s, crc: %d", dataStr, checkSum)
+	}
+	for _, item := range strings.Split(dataStr, ManifestEditSep) {
+		switch {
+		case strings.HasPrefix(item, ManifestAdd):
+			edit.adds = append(edit.adds, strings.TrimPrefix(item, ManifestAdd))
+		case strings.HasPrefix(item, ManifestDel):
+			edit.dels = append(edit.dels, strings.TrimPrefix(item, ManifestDel))
+		case strings.HasPrefix(item, ManifestSeq):
+			if edit.seq, err = strconv.ParseUint(strings.TrimPrefix(item, ManifestSeq), 16, 64); err != nil {
+				return edit, fmt.Errorf("bad manifest seq: %s", item)
+			}
+		case strings.HasPrefix(item, ManifestMaxSeq):
+			name, seqStr, ok := strings.Cut(strings.TrimPrefix(item, ManifestMaxSeq), ManifestMaxSeqSep)
+			seq, err := strconv.ParseUint(seqStr, 16, 64)
+			if !ok || err != nil {
+				return edit, fmt.Errorf("bad manifest max seq: %s", item)
+			}
+			edit.maxSeqs[name] = seq
+		case strings.HasPrefix(item, ManifestCDCFloor):
+			if edit.floor, err = strconv.ParseUint(strings.TrimPrefix(item, ManifestCDCFloor), 16, 64); err != nil {
+				return edit, fmt.Errorf("bad manifest cdc floor: %s", item)
+			}
+		default:
+			return edit, fmt.Errorf("unknown manifest edit: %s", item)
+		}
+	}
+	return edit, nil
+}
@@ -0,0 +1,298 @@
+package xdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 合并操作：Merge 只追加一条操作数记录(KindMerge)，不需要先读取key当前的value；读取时由合并操作符将基础值与之后的操作数合并为完整的value
+// 操作数记录中保存指向同一段文件中该key上一条记录(操作数记录或KindVal记录)的指针，读取时沿指针找到基础值和全部操作数；
+// 操作数链只存在于同一个段文件中，当上一条记录不在活跃段文件中、不是内联value(KindBlob)或者操作数链过长时，Merge 直接写入合并后的完整value
+// 段合并时将操作数链合并为完整的value；无法合并时(例如基础值不合法)将操作数链原样复制到合并生成的段文件，链中除最新记录以外的记录序列号为0
+
+// MergeOperator 合并操作符，将key的基础值与按写入顺序排列的操作数合并为完整的value
+type MergeOperator interface {
+	// FullMerge 合并基础值与操作数；key不存在时exists为false
+	FullMerge(key, base string, exists bool, operands []string) (string, error)
+}
+
+var (
+	mergeOps   = make(map[string]MergeOperator) // 按key前缀注册的合并操作符
+	mergeOpsMu sync.RWMutex
+)
+
+// RegisterMergeOperator 为以prefix开头的key注册合并操作符，key匹配多个前缀时使用最长的前缀；
+// 合并操作符需要在Open之前注册，且不能在存在操作数记录时修改
+func RegisterMergeOperator(prefix string, op MergeOperator) {
+	mergeOpsMu.Lock()
+	defer mergeOpsMu.Unlock()
+	mergeOps[prefix] = op
+}
+
+// mergeOperator 获取key对应的合并操作符
+func mergeOperator(key string) (MergeOperator, error) {
+	mergeOpsMu.RLock()
+	defer mergeOpsMu.RUnlock()
+	var op MergeOperator
+	matched := -1
+	for prefix, o := range mergeOps {
+		if strings.HasPrefix(key, prefix) && len(prefix) > matched {
+			op, matched = o, len(prefix)
+		}
+	}
+	if op == nil {
+		return nil, fmt.Errorf("idxK: %s, no merge operator registered", key)
+	}
+	return op, nil
+}
+
+// Int64Add 内置合并操作符：将value和操作数作为十进制int64相加，key不存在时基础值为0
+type Int64Add struct{}
+
+// FullMerge 累加操作数
+func (Int64Add) FullMerge(key, base string, exists bool, operands []string) (string, error) {
+	var sum int64
+	if exists {
+		n, err := strconv.ParseInt(base, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("idxK: %s, bad int64 value: %s", key, base)
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("idxK: %s, bad int64 operand: %s", key, operand)
+		}
+		sum += n
+	}
+	return strconv.FormatInt(sum, 10), nil
+}
+
+// StringAppend 内置合并操作符：将操作数依次追加到value之后，相邻两项之间插入Delimiter
+type StringAppend struct {
+	Delimiter string // 分隔符
+}
+
+// FullMerge 追加操作数
+func (s StringAppend) FullMerge(_, base string, exists bool, operands []string) (string, error) {
+	if exists {
+		operands = append([]string{base}, operands...)
+	}
+	return strings.Join(operands, s.Delimiter), nil
+}
+
+// Merge 为key追加一个操作数，读取时由key对应的合并操作符合并
+func Merge(key, operand string) error {
+	if key == "" || operand == "" {
+		return fmt.Errorf("idxK, operand can not be empty, idxK: %s, operand: %s", key, operand)
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	op, err := mergeOperator(key)
+	if err != nil {
+		return err
+	}
+	// 拒绝合并操作符无法处理的操作数，避免写入之后读取和段合并失败
+	if _, err = op.FullMerge(key, "", false, []string{operand}); err != nil {
+		return fmt.Errorf("idxK: %s, bad operand: %s, %w", key, operand, err)
+	}
+	return dbEngine.merge(key, operand, op)
+}
+
+// mergePtr 操作数记录中指向上一条记录的指针
+type mergePtr struct {
+	val
+	n int // 操作数链长度(包括当前记录)
+}
+
+// encodeMergePtr 将指针按格式编码
+func encodeMergePtr(ptr mergePtr) string {
+	return fmt.Sprintf(MergePtrFormat, ptr.valops, ptr.valsz, ptr.kind, ptr.codec, ptr.keyID, ptr.n)
+}
+
+// decodeMergePtr 从操作数记录的value中解析指针
+func decodeMergePtr(data string) (mergePtr, error) {
+	ptr := mergePtr{}
+	if len(data) < MergePtrSize {
+		return ptr, fmt.Errorf("bad merge pointer: %s", data)
+	}
+	if _, err := fmt.Sscanf(data[:MergePtrSize], MergePtrFormat, &ptr.valops, &ptr.valsz, &ptr.kind, &ptr.codec, &ptr.keyID, &ptr.n); err != nil {
+		return ptr, fmt.Errorf("decode merge pointer: %s error: %v", data, err)
+	}
+	return ptr, nil
+}
+
+// merge 持有段文件锁，追加操作数记录；不满足操作数链条件时写入合并后的完整value
+func (engine *DBEngine) merge(key, operand string, op MergeOperator) error {
+	stored, codecID, keyID, err := engine.encodeVal(key, operand)
+	if err != nil {
+		return err
+	}
+	seg := &Segment{
+		Hint: Hint{
+			key:   key,
+			keysz: len(key),
+			val:   val{tm: time.Now().UnixNano(), codec: codecID, keyID: keyID},
+		},
+	}
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	cur, ok := engine.getMemIdx(key)
+	ptr := mergePtr{val: cur.val, n: 1}
+	chain := ok && cur.fName == engine.segFName && engine.segFLen(engine.segFName) < SegSizeLimit &&
+		(cur.kind == KindVal || cur.kind == KindMerge) && MergePtrSize+len(stored) <= engine.blobThreshold
+	if chain && cur.kind == KindMerge {
+		buf, err := engine.readRec(cur)
+		if err != nil {
+			return err
+		}
+		pre, err := decodeMergePtr(string(buf))
+		if err != nil {
+			return err
+		}
+		ptr.n = pre.n + 1
+		chain = ptr.n <= MaxMergeOps
+	}
+	if chain {
+		seg.kind, seg.value = KindMerge, encodeMergePtr(ptr)+stored
+	} else {
+		var base string
+		if ok {
+			if base, err = engine.seekKey(key, cur); err != nil {
+				return fmt.Errorf("idxK: %s, read value error: %v", key, err)
+			}
+		}
+		value, err := op.FullMerge(key, base, ok, []string{operand})
+		if err != nil {
+			return err
+		}
+		if seg.value, seg.codec, seg.keyID, err = engine.encodeVal(key, value); err != nil {
+			return err
+		}
+	}
+	seg.valsz = len(seg.value)
+	if err = engine.appendSegLocked(seg); err != nil && !errors.Is(err, ErrClosed) {
+		slogger.Fatalf("write seg to file: %s error: %v", engine.segFName, err)
+	}
+	return err
+}
+
+// seekMerge 沿操作数记录中的指针读取基础值和全部操作数，合并为完整的value
+func (engine *DBEngine) seekMerge(key string, index MemIdxV) (string, error) {
+	op, err := mergeOperator(key)
+	if err != nil {
+		return "", err
+	}
+	operands := make([]string, 0)
+	for index.kind == KindMerge {
+		buf, err := engine.readRec(index)
+		if err != nil {
+			return "", err
+		}
+		ptr, err := decodeMergePtr(string(buf))
+		if err != nil {
+			return "", err
+		}
+		operand, err := engine.decodeVal(key, buf[MergePtrSize:], index.codec, index.keyID)
+		if err != nil {
+			return "", err
+		}
+		operands = append(operands, operand)
+		index.val = ptr.val
+	}
+	base, err := engine.seekKey(key, index)
+	if err != nil {
+		return "", err
+	}
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	return op.FullMerge(key, base, true, operands)
+}
+
+// foldMergeSeg 段合并时将操作数链合并为完整的value，value超过blob阈值时写入blob文件
+func (engine *DBEngine) foldMergeSeg(seg *Segment, index MemIdxV) error {
+	value, err := engine.seekMerge(seg.key, index)
+	if err != nil {
+		return err
+	}
+	if seg.value, seg.codec, seg.keyID, err = engine.encodeVal(seg.key, value); err != nil {
+		return err
+	}
+	seg.kind, seg.valsz = KindVal, len(seg.value)
+	if seg.valsz <= engine.blobThreshold {
+		return nil
+	}
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	ptr, err := engine.writeBlob(seg)
+	if err != nil {
+		return err
+	}
+	seg.kind, seg.value, seg.valsz = KindBlob, ptr, len(ptr)
+	return nil
+}
+
+// copyMergeChain 段合并时将操作数链中的基础值和操作数按写入顺序复制到合并生成的段文件，并更新记录中指向上一条记录的指针；
+// 最新的操作数记录seg由调用方写入，链中的其他记录序列号为0，不生成hint，只能通过指针读取
+func (engine *DBEngine) copyMergeChain(comp *compF, seg *Segment, index MemIdxV) error {
+	head := index
+	ptrs := make([]mergePtr, 0)
+	operands := make([][]byte, 0)
+	for index.kind == KindMerge {
+		buf, err := engine.readRec(index)
+		if err != nil {
+			return err
+		}
+		ptr, err := decodeMergePtr(string(buf))
+		if err != nil {
+			return err
+		}
+		ptrs = append(ptrs, ptr)
+		operands = append(operands, buf[MergePtrSize:])
+		index.val = ptr.val
+	}
+	base, err := engine.readRec(index)
+	if err != nil {
+		return err
+	}
+	rec := &Segment{
+		value: string(base),
+		Hint: Hint{
+			key:   seg.key,
+			keysz: len(seg.key),
+			val:   val{tm: seg.tm, kind: index.kind, codec: index.codec, keyID: index.keyID, valsz: len(base)},
+		},
+	}
+	for i := len(ptrs) - 1; ; i-- {
+		if err = comp.writeSeg(rec, engine.crypt); err != nil {
+			return err
+		}
+		ptrs[i].valops, ptrs[i].valsz = rec.valops, rec.valsz
+		if i == 0 {
+			break
+		}
+		value := encodeMergePtr(ptrs[i]) + string(operands[i])
+		rec = &Segment{
+			value: value,
+			Hint: Hint{
+				key:   seg.key,
+				keysz: len(seg.key),
+				val:   val{tm: seg.tm, kind: KindMerge, codec: ptrs[i-1].codec, keyID: ptrs[i-1].keyID, valsz: len(value)},
+			},
+		}
+	}
+	seg.kind, seg.codec, seg.keyID = KindMerge, head.codec, head.keyID
+	seg.value = encodeMergePtr(ptrs[0]) + string(operands[0])
+	seg.valsz = len(seg.value)
+	return nil
+}
@@ -0,0 +1,32 @@
+package xdb
+
+// Options 数据库引擎配置
+type Options struct {
+	DataDir           string      // 数据文件保存目录，默认：DataDir
+	Codec             Codec       // value 压缩编解码器，默认：NoneCodec(不压缩)
+	CompressThreshold int         // value 长度小于该值时不压缩，默认：DefaultCompressThreshold
+	BlobThreshold     int         // value(压缩、加密后)长度超过该值时保存到blob文件，默认：DefaultBlobThreshold，最大值：MaxValSize
+	KeyProvider       KeyProvider // 数据加密密钥提供者，设置后使用AES-GCM加密段文件中的key、value及hint文件中的key，默认：nil(不加密)
+	Retention         Retention   // 历史版本保留策略，默认：只保留当前版本
+	Indexes           []Index     // 桶上的二级索引，引擎启动时构建尚未构建完成的索引，默认：无
+}
+
+// withDefaults 为未设置的配置项填充默认值
+func (opts Options) withDefaults() Options {
+	if opts.DataDir == "" {
+		opts.DataDir = DataDir
+	}
+	if opts.Codec == nil {
+		opts.Codec = NoneCodec
+	}
+	if opts.CompressThreshold <= 0 {
+		opts.CompressThreshold = DefaultCompressThreshold
+	}
+	if opts.BlobThreshold <= 0 {
+		opts.BlobThreshold = DefaultBlobThreshold
+	}
+	if opts.BlobThreshold > MaxValSize {
+		opts.BlobThreshold = MaxValSize
+	}
+	return opts
+}
@@ -0,0 +1,75 @@
+package xdb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// RecoveryInfo 引擎启动时对活跃段文件尾部残缺数据(写入中断导致)的恢复结果
+type RecoveryInfo struct {
+	SegFName        string // 发生恢复的段文件名称
+	ValidSize       int64  // 恢复后段文件长度，即最后一条有效记录的结束位置
+	TruncatedBytes  int64  // 被截断的字节数
+	QuarantineFName string // 保存被截断数据的隔离文件名称
+}
+
+// Recovered 返回最近一次Open时的恢复结果；若活跃段文件完好，返回nil
+func Recovered() *RecoveryInfo {
+	if dbEngine == nil {
+		return nil
+	}
+	return dbEngine.recovery
+}
+
+// recoverSegF 通过CRC校验找到段文件中最后一条有效记录，将其后的残缺数据移动到隔离文件，并截断段文件
+func (engine *DBEngine) recoverSegF(segFName string) (*RecoveryInfo, error) {
+	segPath := path.Join(engine.dataDir, segFName)
+	f, err := os.OpenFile(segPath, os.O_RDWR, FileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open segment file: %s error: %v", segPath, err)
+	}
+	defer f.Close()
+	// 1. 跳过文件头，顺序扫描段文件，记录最后一条有效记录的结束位置；没有提交记录的批量写入同样视为残缺数据
+	reader := bufio.NewReader(f)
+	if _, err = readFHeader(reader, SegFMagic); err != nil {
+		return nil, fmt.Errorf("segment file: %s error: %w", segPath, err)
+	}
+	validSize, err := engine.scanSegF(reader, FHeaderSize, nil)
+	if err != nil {
+		return nil, fmt.Errorf("read segment file: %s error: %v", segPath, err)
+	}
+	fInfo, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat segment file: %s error: %v", segPath, err)
+	}
+	offset := fInfo.Size()
+	if validSize == offset {
+		return nil, nil
+	}
+	// 2. 将残缺数据写入隔离文件
+	tail := make([]byte, offset-validSize)
+	if _, err = f.ReadAt(tail, validSize); err != nil {
+		return nil, fmt.Errorf("read segment file: %s tail error: %v", segPath, err)
+	}
+	quarantineFName := fmt.Sprintf(DataFNameFormat, QuarantineFNamePrefix, time.Now().UnixNano())
+	quarantinePath := path.Join(engine.dataDir, quarantineFName)
+	if err = os.WriteFile(quarantinePath, tail, FileMode); err != nil {
+		return nil, fmt.Errorf("write quarantine file: %s error: %v", quarantinePath, err)
+	}
+	// 3. 截断段文件
+	if err = f.Truncate(validSize); err != nil {
+		return nil, fmt.Errorf("truncate segment file: %s error: %v", segPath, err)
+	}
+	if err = f.Sync(); err != nil {
+		return nil, fmt.Errorf("sync segment file: %s error: %v", segPath, err)
+	}
+	return &RecoveryInfo{
+		SegFName:        segFName,
+		ValidSize:       validSize,
+		TruncatedBytes:  offset - validSize,
+		QuarantineFName: quarantineFName,
+	}, nil
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CatchTheDog/xdb"
+)
+
+const (
+	MaxBodySize      = 16 << 20 // 请求体的最大长度
+	DefaultListLimit = 100      // 列出key时每页的默认数量
+	MaxListLimit     = 1000     // 列出key时每页的最大数量
+	MaxBatchSize     = 1000     // 批量请求中的最大操作数
+)
+
+// HTTP 接口：
+//
+//	GET    /kv/{key}                      读取key，key不存在时返回404
+//	PUT    /kv/{key}                      请求体为value
+//	DELETE /kv/{key}                      删除key
+//	GET    /kv?prefix=&after=&limit=      按字典序列出以prefix开头、大于after的key，返回{"keys":[...],"next":"..."}，next为空表示没有更多key
+//	POST   /batch                         {"ops":[{"op":"put","key":"k","value":"v"},{"op":"delete","key":"k"}]}，全部操作在一个事务中原子地提交
+//	POST   /batch/get                     {"keys":["k1","k2"]}，返回{"values":{"k1":"v1"}}，不存在的key不返回
+//	GET    /put?key=&value=、/get?key=    兼容旧接口
+//
+// 出错时返回{"error":"..."}
+
+// HTTPServer xdb的HTTP服务
+type HTTPServer struct {
+	srv *http.Server
+}
+
+// NewHTTPServer 创建监听addr的HTTP服务
+func NewHTTPServer(addr string) *HTTPServer {
+	s := &HTTPServer{}
+	s.srv = &http.Server{Addr: addr, Handler: s.Handler()}
+	return s
+}
+
+// Handler 返回处理全部HTTP接口的Handler
+func (s *HTTPServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", s.handleKV)
+	mux.HandleFunc("/kv", s.handleList)
+	mux.HandleFunc("/batch", s.handleBatch)
+	mux.HandleFunc("/batch/get", s.handleBatchGet)
+	mux.HandleFunc("/put", s.handleLegacyPut)
+	mux.HandleFunc("/get", s.handleLegacyGet)
+	return mux
+}
+
+// ListenAndServe 开始监听并处理请求，Shutdown之后返回http.ErrServerClosed
+func (s *HTTPServer) ListenAndServe() error {
+	return s.srv.ListenAndServe()
+}
+
+// Shutdown 停止接收新的请求，等待正在处理的请求完成
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	if err := s.srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown http server error: %v", err)
+	}
+	return nil
+}
+
+// httpError 带有HTTP状态码的错误
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+// badRequest 创建状态码为400的错误
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+// writeJSON 以JSON格式返回响应
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slogger.Errorf("write response error: %v", err)
+	}
+}
+
+// writeErr 以JSON格式返回错误
+func writeErr(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var he *httpError
+	switch {
+	case errors.As(err, &he):
+		status = he.status
+	case errors.Is(err, xdb.ErrConflict):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// readBody 读取请求体，超过MaxBodySize时返回错误
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+	if err != nil {
+		return nil, badRequest("read request body error: %v", err)
+	}
+	if len(body) > MaxBodySize {
+		return nil, &httpError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("request body exceeds limit: %d", MaxBodySize)}
+	}
+	return body, nil
+}
+
+// query 读取key，key不存在或已过期时返回状态码为404的错误
+func query(key string) (string, error) {
+	value, ok, err := getKV(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", &httpError{status: http.StatusNotFound, msg: fmt.Sprintf("key: %s not found", key)}
+	}
+	return value, nil
+}
+
+// handleKV 处理单个key的读取、写入和删除
+func (s *HTTPServer) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if key == "" {
+		s.handleList(w, r)
+		return
+	}
+	if err := checkKey(key); err != nil {
+		writeErr(w, badRequest("%v", err))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, err := query(key)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"key": key, "value": value})
+	case http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		if err = setKV(key, string(body), meta{}); err != nil {
+			writeErr(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if _, err := delKV(key); err != nil {
+			writeErr(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeErr(w, &httpError{status: http.StatusMethodNotAllowed, msg: fmt.Sprintf("method: %s not allowed", r.Method)})
+	}
+}
+
+// listPage 列出key的一页结果
+type listPage struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next"` // 下一页的after参数，为空表示没有更多key
+}
+
+// handleList 按字典序分页列出以prefix开头的key
+func (s *HTTPServer) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeErr(w, &httpError{status: http.StatusMethodNotAllowed, msg: fmt.Sprintf("method: %s not allowed", r.Method)})
+		return
+	}
+	params := r.URL.Query()
+	prefix, after := params.Get("prefix"), params.Get("after")
+	limit := DefaultListLimit
+	if l := params.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > MaxListLimit {
+			writeErr(w, badRequest("bad limit: %q, should be in [1, %d]", l, MaxListLimit))
+			return
+		}
+		limit = n
+	}
+	all, err := liveKeys(prefix)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	keys := all[sort.SearchStrings(all, after):]
+	if len(keys) > 0 && keys[0] == after {
+		keys = keys[1:]
+	}
+	page := listPage{Keys: keys}
+	if len(keys) > limit {
+		page.Keys = keys[:limit]
+		page.Next = keys[limit-1]
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// batchOp 批量写入中的一个操作
+type batchOp struct {
+	Op    string `json:"op"` // put 或 delete
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// handleBatch 在一个事务中原子地执行一组写入和删除
+func (s *HTTPServer) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ops []batchOp `json:"ops"`
+	}
+	if err := decodeBatch(r, &req); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if len(req.Ops) == 0 || len(req.Ops) > MaxBatchSize {
+		writeErr(w, badRequest("bad op num: %d, should be in [1, %d]", len(req.Ops), MaxBatchSize))
+		return
+	}
+	for i, op := range req.Ops {
+		err := checkKey(op.Key)
+		if err == nil && op.Op != "put" && op.Op != "delete" {
+			err = fmt.Errorf("unknown op: %q", op.Op)
+		}
+		if err != nil {
+			writeErr(w, badRequest("op %d: %v", i, err))
+			return
+		}
+	}
+	err := update(func(txn *xdb.Txn) error {
+		for _, op := range req.Ops {
+			old, err := readItem(txn, op.Key)
+			if err != nil {
+				return err
+			}
+			var value *string
+			if op.Op == "put" {
+				value = &op.Value
+			}
+			if err = writeItem(txn, op.Key, old, value, meta{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBatchGet 批量读取key，不存在的key不返回
+func (s *HTTPServer) handleBatchGet(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := decodeBatch(r, &req); err != nil {
+		writeErr(w, err)
+		return
+	}
+	if len(req.Keys) > MaxBatchSize {
+		writeErr(w, badRequest("bad key num: %d, should be in [0, %d]", len(req.Keys), MaxBatchSize))
+		return
+	}
+	values := make(map[string]string, len(req.Keys))
+	for _, key := range req.Keys {
+		if err := checkKey(key); err != nil {
+			writeErr(w, badRequest("%v", err))
+			return
+		}
+		value, ok, err := getKV(key)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		if ok {
+			values[key] = value
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]map[string]string{"values": values})
+}
+
+// decodeBatch 解析批量请求的请求体
+func decodeBatch(r *http.Request, req interface{}) error {
+	if r.Method != http.MethodPost {
+		return &httpError{status: http.StatusMethodNotAllowed, msg: fmt.Sprintf("method: %s not allowed", r.Method)}
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, req); err != nil {
+		return badRequest("decode request body error: %v", err)
+	}
+	return nil
+}
+
+// handleLegacyPut 兼容旧接口：/put?key=&value=
+func (s *HTTPServer) handleLegacyPut(w http.ResponseWriter, r *http.Request) {
+	key, value := r.URL.Query().Get("key"), r.URL.Query().Get("value")
+	err := checkKey(key)
+	if err != nil {
+		writeErr(w, badRequest("%v", err))
+		return
+	}
+	if err = setKV(key, value, meta{}); err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLegacyGet 兼容旧接口：/get?key=，返回value原文
+func (s *HTTPServer) handleLegacyGet(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if err := checkKey(key); err != nil {
+		writeErr(w, badRequest("%v", err))
+		return
+	}
+	value, err := query(key)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, value)
+}
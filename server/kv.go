@@ -0,0 +1,301 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/CatchTheDog/xdb"
+)
+
+// 各协议共用的键值操作：
+// 1. key不能包含空白字符，以控制字符开头的key保留给引擎内部使用，写入前检查客户端传入的key；value可以为任意字节，原样保存；
+//    引擎中空value表示删除，空value保存为emptyValue，并在元数据中标记
+// 2. key的元数据(过期时间、flags)保存在内部key：metaPrefix+key 中，metaPrefix 位于引擎为调用方保留的前缀范围(xdb.ReservedPrefix)内，只在不为默认值时存在；key与元数据通过事务原子地读写
+// 3. 过期的key在读取时视为不存在，由后台清理(sweepExpired)删除；直接通过xdb.Remove删除key时遗留的元数据同样由后台清理删除
+
+const (
+	MaxTxnRetries = 16          // 事务冲突时的最大重试次数
+	SweepInterval = time.Minute // 清理过期key的时间间隔
+)
+
+// metaPrefix 保存key元数据的内部key前缀
+var metaPrefix = func() string {
+	prefix, err := xdb.ReservedPrefix("meta")
+	if err != nil {
+		panic(err)
+	}
+	return prefix
+}()
+
+// checkKey 检查客户端传入的key
+func checkKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key can not be empty")
+	}
+	if len(key) > xdb.MaxKeySize {
+		return fmt.Errorf("key size: %d exceeds limit: %d", len(key), xdb.MaxKeySize)
+	}
+	if strings.IndexFunc(key, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("key: %q can not contain space or control characters", key)
+	}
+	return nil
+}
+
+// emptyValue 空value在引擎中保存的value，元数据中的empty标记表示其实际为空
+const emptyValue = "\x00"
+
+// meta key的元数据
+type meta struct {
+	deadline int64  // 过期时间(unix毫秒)，0表示不过期
+	flags    uint32 // memcached 协议中客户端为key设置的flags
+	empty    bool   // value是否为空(引擎中保存为emptyValue)，由writeItem设置
+}
+
+// metaKey 获取保存key元数据的内部key
+func metaKey(key string) string {
+	return metaPrefix + key
+}
+
+// encode 编码元数据(过期时间,flags[,e])，value为空时增加e标记，默认值编码为空字符串
+func (m meta) encode() string {
+	if m == (meta{}) {
+		return ""
+	}
+	data := strconv.FormatInt(m.deadline, 10) + "," + strconv.FormatUint(uint64(m.flags), 10)
+	if m.empty {
+		data += ",e"
+	}
+	return data
+}
+
+// decodeMeta 解析元数据，只有过期时间时flags为0
+func decodeMeta(data string) (meta, error) {
+	if data == "" {
+		return meta{}, nil
+	}
+	fields := strings.Split(data, ",")
+	deadline, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || len(fields) > 3 || (len(fields) == 3 && fields[2] != "e") {
+		return meta{}, fmt.Errorf("bad key meta: %q", data)
+	}
+	m := meta{deadline: deadline, empty: len(fields) == 3}
+	if len(fields) > 1 {
+		flags, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return meta{}, fmt.Errorf("bad key meta: %q", data)
+		}
+		m.flags = uint32(flags)
+	}
+	return m, nil
+}
+
+// expired 判断key在now(unix毫秒)时刻是否已过期
+func (m meta) expired(now int64) bool {
+	return m.deadline > 0 && m.deadline <= now
+}
+
+// nowMs 返回当前时间(unix毫秒)
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// item 事务中读取的key
+type item struct {
+	value   string // 未过期时key的value
+	meta    meta   // 未过期时key的元数据
+	version uint64 // 未过期时key的版本号(记录的序列号)，用于比较并交换
+	exists  bool   // key是否存在且未过期
+	hasMeta bool   // 元数据key是否存在(包括已过期的key)
+}
+
+// readItem 在事务中读取key及其元数据，已过期的key视为不存在
+func readItem(txn *xdb.Txn, key string) (item, error) {
+	it := item{}
+	value, version, err := txn.GetVersion(key)
+	if err != nil {
+		return it, err
+	}
+	data, err := txn.Get(metaKey(key))
+	if err != nil {
+		return it, err
+	}
+	m, err := decodeMeta(data)
+	if err != nil {
+		return it, err
+	}
+	it.hasMeta = data != ""
+	if value != "" && !m.expired(nowMs()) {
+		if m.empty {
+			value = ""
+		}
+		it.value, it.meta, it.version, it.exists = value, m, version, true
+	}
+	return it, nil
+}
+
+// writeItem 在事务中写入key及其元数据；old为事务中读取的key，value为nil表示删除
+func writeItem(txn *xdb.Txn, key string, old item, value *string, m meta) error {
+	m.empty = value != nil && *value == ""
+	switch {
+	case value == nil:
+		if old.exists {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		m = meta{}
+	case m.empty:
+		if err := txn.Put(key, emptyValue); err != nil {
+			return err
+		}
+	default:
+		if err := txn.Put(key, *value); err != nil {
+			return err
+		}
+	}
+	if data := m.encode(); data != "" {
+		return txn.Put(metaKey(key), data)
+	}
+	if old.hasMeta {
+		return txn.Delete(metaKey(key))
+	}
+	return nil
+}
+
+// update 在事务中执行fn，提交冲突时重试
+func update(fn func(txn *xdb.Txn) error) error {
+	var err error
+	for i := 0; i < MaxTxnRetries; i++ {
+		txn := xdb.Begin()
+		if err = fn(txn); err != nil {
+			txn.Rollback()
+			return err
+		}
+		if err = txn.Commit(); !errors.Is(err, xdb.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// getKV 读取key，key不存在或已过期时返回false
+func getKV(key string) (string, bool, error) {
+	var it item
+	err := update(func(txn *xdb.Txn) error {
+		var err error
+		it, err = readItem(txn, key)
+		return err
+	})
+	return it.value, it.exists, err
+}
+
+// setKV 写入key并设置元数据
+func setKV(key, value string, m meta) error {
+	return update(func(txn *xdb.Txn) error {
+		old, err := readItem(txn, key)
+		if err != nil {
+			return err
+		}
+		return writeItem(txn, key, old, &value, m)
+	})
+}
+
+// delKV 删除key及其元数据，返回删除前key是否存在且未过期
+func delKV(key string) (bool, error) {
+	var existed bool
+	err := update(func(txn *xdb.Txn) error {
+		old, err := readItem(txn, key)
+		if err != nil {
+			return err
+		}
+		existed = old.exists
+		return writeItem(txn, key, old, nil, meta{})
+	})
+	return existed, err
+}
+
+// liveKeys 按字典序返回以prefix开头且未过期的key，不包括引擎内部使用的key
+func liveKeys(prefix string) ([]string, error) {
+	snap := xdb.Snapshot()
+	defer snap.Release()
+	now := nowMs()
+	expired := make(map[string]bool)
+	err := snap.ForEach(metaPrefix+prefix, func(k, v string) bool {
+		if m, err := decodeMeta(v); err == nil && m.expired(now) {
+			expired[k[len(metaPrefix):]] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, k := range snap.Keys(prefix) {
+		if !expired[k] && !strings.HasPrefix(k, xdb.BucketKeyPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// sweepExpired 删除已过期的key及元数据，以及key已被删除的元数据
+func sweepExpired() {
+	snap := xdb.Snapshot()
+	keys := make([]string, 0)
+	now := nowMs()
+	err := snap.ForEach(metaPrefix, func(k, v string) bool {
+		m, err := decodeMeta(v)
+		if err != nil {
+			slogger.Errorf("key meta: %s error: %v", k, err)
+			return true
+		}
+		key := k[len(metaPrefix):]
+		if m.expired(now) {
+			keys = append(keys, key)
+		} else if value, _ := snap.Get(key); value == "" {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	snap.Release()
+	if err != nil {
+		slogger.Errorf("scan key meta error: %v", err)
+		return
+	}
+	for _, key := range keys {
+		err = update(func(txn *xdb.Txn) error {
+			old, err := readItem(txn, key)
+			if err != nil || old.exists {
+				return err
+			}
+			// 已过期的key需要删除value，readItem将其视为不存在
+			if value, _ := txn.Get(key); value != "" {
+				if err = txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return writeItem(txn, key, old, nil, meta{})
+		})
+		if err != nil {
+			slogger.Errorf("sweep expired key: %s error: %v", key, err)
+		}
+	}
+}
+
+// runSweeper 定期清理过期的key，stopCh关闭时返回
+func runSweeper(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			sweepExpired()
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/CatchTheDog/xdb"
+)
+
+// memcached 文本协议服务：支持 get、gets、set、add、replace、cas、delete、incr、decr、quit
+// flags 与过期时间保存在key的元数据中；gets 返回的cas值为key当前记录的序列号，cas 在事务中比较序列号并写入
+// exptime 为0表示不过期，不超过MemcacheMaxRelExptime时为相对秒数，否则为unix时间戳；为负数或已经过去的时间戳时key立即过期
+
+const (
+	MemcacheMaxRelExptime = 60 * 60 * 24 * 30 // exptime 作为相对秒数的最大值(30天)
+	MaxMemcacheKeys       = 1 << 10           // get/gets 一次读取的最大key数量
+)
+
+// memcacheClientError 客户端请求格式错误，返回CLIENT_ERROR
+type memcacheClientError struct {
+	msg string
+}
+
+func (e *memcacheClientError) Error() string {
+	return e.msg
+}
+
+// MemcacheServer memcached 文本协议服务
+type MemcacheServer struct {
+	*tcpServer
+}
+
+// NewMemcacheServer 创建监听addr的memcached协议服务
+func NewMemcacheServer(addr string) *MemcacheServer {
+	s := &MemcacheServer{}
+	s.tcpServer = newTCPServer(addr, s.serveConn)
+	return s
+}
+
+// serveConn 处理一个连接上的请求
+func (s *MemcacheServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.WriteString("CLIENT_ERROR line too long\r\n")
+				w.Flush()
+			}
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if quit, err := s.exec(r, w, fields); err != nil {
+			var ce *memcacheClientError
+			if !errors.As(err, &ce) {
+				// 读取请求数据出错，连接已不可用
+				return
+			}
+			w.WriteString("CLIENT_ERROR " + ce.msg + "\r\n")
+		} else if quit {
+			w.Flush()
+			return
+		}
+		// 客户端批量发送的命令全部执行后再发送响应
+		if r.Buffered() == 0 {
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+		if s.closing() {
+			w.Flush()
+			return
+		}
+	}
+}
+
+// clientErr 创建客户端请求格式错误
+func clientErr(format string, args ...interface{}) error {
+	return &memcacheClientError{msg: fmt.Sprintf(format, args...)}
+}
+
+// exec 执行一条命令，返回连接是否需要关闭；返回memcacheClientError以外的错误时连接需要关闭
+func (s *MemcacheServer) exec(r *bufio.Reader, w *bufio.Writer, fields []string) (bool, error) {
+	switch cmd := fields[0]; cmd {
+	case "get", "gets":
+		return false, memcacheGet(w, fields[1:], cmd == "gets")
+	case "set", "add", "replace", "cas":
+		return false, memcacheStore(r, w, cmd, fields[1:])
+	case "delete":
+		return false, memcacheDelete(w, fields[1:])
+	case "incr", "decr":
+		return false, memcacheIncr(w, fields[1:], cmd == "incr")
+	case "quit":
+		return true, nil
+	default:
+		w.WriteString("ERROR\r\n")
+		return false, nil
+	}
+}
+
+// noreply 判断命令参数中的第n个参数是否为noreply
+func noreply(args []string, n int) bool {
+	return len(args) == n+1 && args[n] == "noreply"
+}
+
+// reply 发送响应，noreply 时不发送
+func reply(w *bufio.Writer, quiet bool, msg string) {
+	if !quiet {
+		w.WriteString(msg + "\r\n")
+	}
+}
+
+// memcacheGet get/gets <key>*
+func memcacheGet(w *bufio.Writer, keys []string, withCAS bool) error {
+	if len(keys) == 0 || len(keys) > MaxMemcacheKeys {
+		return clientErr("bad key num: %d", len(keys))
+	}
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return clientErr("%v", err)
+		}
+	}
+	for _, key := range keys {
+		var it item
+		err := update(func(txn *xdb.Txn) error {
+			var err error
+			it, err = readItem(txn, key)
+			return err
+		})
+		if err != nil {
+			w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+			return nil
+		}
+		if !it.exists {
+			continue
+		}
+		w.WriteString(fmt.Sprintf("VALUE %s %d %d", key, it.meta.flags, len(it.value)))
+		if withCAS {
+			w.WriteString(" " + strconv.FormatUint(it.version, 10))
+		}
+		w.WriteString("\r\n" + it.value + "\r\n")
+	}
+	w.WriteString("END\r\n")
+	return nil
+}
+
+// memcacheStore set/add/replace <key> <flags> <exptime> <bytes> [noreply]、cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func memcacheStore(r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+	if len(args) != n && !noreply(args, n) {
+		return clientErr("bad command line format")
+	}
+	key := args[0]
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	var casUnique uint64
+	var err4 error
+	if cmd == "cas" {
+		casUnique, err4 = strconv.ParseUint(args[4], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || size > MaxBodySize {
+		return clientErr("bad command line format")
+	}
+	// 读取数据块，之后再检查key和value，保证连接上的后续命令可以正确解析
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		return clientErr("bad data chunk")
+	}
+	value := string(data[:size])
+	if err := checkKey(key); err != nil {
+		return clientErr("%v", err)
+	}
+	m := meta{deadline: memcacheDeadline(exptime, nowMs()), flags: uint32(flags)}
+	var result string
+	err := update(func(txn *xdb.Txn) error {
+		old, err := readItem(txn, key)
+		if err != nil {
+			return err
+		}
+		switch {
+		case cmd == "add" && old.exists, cmd == "replace" && !old.exists:
+			result = "NOT_STORED"
+			return nil
+		case cmd == "cas" && !old.exists:
+			result = "NOT_FOUND"
+			return nil
+		case cmd == "cas" && old.version != casUnique:
+			result = "EXISTS"
+			return nil
+		}
+		result = "STORED"
+		return writeItem(txn, key, old, &value, m)
+	})
+	if err != nil {
+		result = "SERVER_ERROR " + err.Error()
+	}
+	reply(w, noreply(args, n), result)
+	return nil
+}
+
+// memcacheDeadline 将exptime转换为过期时间(unix毫秒)，0表示不过期
+func memcacheDeadline(exptime, now int64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return now
+	case exptime <= MemcacheMaxRelExptime:
+		return now + exptime*1000
+	case exptime > (1<<63-1)/1000:
+		return 1<<63 - 1
+	default:
+		return exptime * 1000
+	}
+}
+
+// memcacheDelete delete <key> [noreply]
+func memcacheDelete(w *bufio.Writer, args []string) error {
+	if len(args) != 1 && !noreply(args, 1) {
+		return clientErr("bad command line format")
+	}
+	if err := checkKey(args[0]); err != nil {
+		return clientErr("%v", err)
+	}
+	existed, err := delKV(args[0])
+	result := "NOT_FOUND"
+	switch {
+	case err != nil:
+		result = "SERVER_ERROR " + err.Error()
+	case existed:
+		result = "DELETED"
+	}
+	reply(w, noreply(args, 1), result)
+	return nil
+}
+
+// memcacheIncr incr/decr <key> <value> [noreply]：incr 超过64位无符号整数最大值时回绕，decr 结果最小为0；保留flags和过期时间
+func memcacheIncr(w *bufio.Writer, args []string, incr bool) error {
+	if len(args) != 2 && !noreply(args, 2) {
+		return clientErr("bad command line format")
+	}
+	key := args[0]
+	if err := checkKey(key); err != nil {
+		return clientErr("%v", err)
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return clientErr("invalid numeric delta argument")
+	}
+	var result string
+	err = update(func(txn *xdb.Txn) error {
+		old, err := readItem(txn, key)
+		if err != nil {
+			return err
+		}
+		if !old.exists {
+			result = "NOT_FOUND"
+			return nil
+		}
+		n, err := strconv.ParseUint(old.value, 10, 64)
+		if err != nil {
+			return clientErr("cannot increment or decrement non-numeric value")
+		}
+		switch {
+		case incr:
+			n += delta
+		case n < delta:
+			n = 0
+		default:
+			n -= delta
+		}
+		result = strconv.FormatUint(n, 10)
+		return writeItem(txn, key, old, &result, old.meta)
+	})
+	if err != nil {
+		var ce *memcacheClientError
+		if errors.As(err, &ce) {
+			return err
+		}
+		result = "SERVER_ERROR " + err.Error()
+	}
+	reply(w, noreply(args, 2), result)
+	return nil
+}
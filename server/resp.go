@@ -0,0 +1,579 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CatchTheDog/xdb"
+)
+
+// Redis RESP2 协议服务：支持 GET、SET(EX/PX/NX/XX)、DEL、EXISTS、KEYS、SCAN(MATCH/COUNT)、MGET、MSET、INCR、PING、QUIT
+// 请求为bulk string数组，也支持以空格分隔的内联命令；SET NX/XX、MSET、INCR 通过事务原子地完成
+// SCAN 按key的64位FNV-1a哈希值顺序遍历，游标为下一个key的哈希值，遍历期间一直存在的key一定会被返回；
+// 游标为0时生成按哈希值排序的key列表并缓存在连接上，之后的调用直接从缓存中定位，遍历结束时释放，遍历期间删除的key可能仍被返回
+
+const (
+	MaxRESPArgs      = 1 << 16 // 一条命令的最大参数个数
+	DefaultScanCount = 10      // SCAN 每次返回的默认key数量
+)
+
+// RESPServer Redis RESP2 协议服务
+type RESPServer struct {
+	*tcpServer
+}
+
+// NewRESPServer 创建监听addr的RESP服务
+func NewRESPServer(addr string) *RESPServer {
+	s := &RESPServer{}
+	s.tcpServer = newTCPServer(addr, s.serveConn)
+	return s
+}
+
+// serveConn 处理一个连接上的请求
+func (s *RESPServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := &respWriter{Writer: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				w.writeError("ERR " + err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(w, args)
+		// 客户端批量发送的命令全部执行后再发送响应
+		if r.Buffered() == 0 || quit {
+			if err = w.Flush(); err != nil || quit {
+				return
+			}
+		}
+		if s.closing() {
+			w.Flush()
+			return
+		}
+	}
+}
+
+// readCommand 读取一条命令，返回命令及参数
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		// 内联命令
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > MaxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MaxBodySize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if string(buf[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// respWriter 按RESP协议编码响应，同时保存连接上进行中的SCAN遍历
+type respWriter struct {
+	*bufio.Writer
+	scanKeys []hashedKey // SCAN 遍历的key列表，按哈希值排序
+}
+
+// hashedKey SCAN 遍历的key及其哈希值
+type hashedKey struct {
+	hash uint64
+	key  string
+}
+
+func (w *respWriter) writeSimple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w *respWriter) writeError(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w *respWriter) writeInt(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) writeBulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *respWriter) writeNull() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) writeArray(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// respHandler 命令处理函数，args[0]为命令名称
+type respHandler func(w *respWriter, args []string)
+
+// respCommand 命令
+type respCommand struct {
+	handler respHandler
+	arity   int // 参数个数(包括命令名称)，负数表示至少-arity个
+}
+
+var respCommands = map[string]respCommand{
+	"ping":   {respPing, -1},
+	"get":    {respGet, 2},
+	"set":    {respSet, -3},
+	"del":    {respDel, -2},
+	"exists": {respExists, -2},
+	"keys":   {respKeys, 2},
+	"scan":   {respScan, -2},
+	"mget":   {respMGet, -2},
+	"mset":   {respMSet, -3},
+	"incr":   {respIncr, 2},
+}
+
+// exec 执行一条命令，返回连接是否需要关闭
+func (s *RESPServer) exec(w *respWriter, args []string) bool {
+	name := strings.ToLower(args[0])
+	if name == "quit" {
+		w.writeSimple("OK")
+		return true
+	}
+	cmd, ok := respCommands[name]
+	if !ok {
+		w.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+	cmd.handler(w, args)
+	return false
+}
+
+// writeErr 返回命令执行错误
+func (w *respWriter) writeErr(err error) {
+	w.writeError("ERR " + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error()))
+}
+
+// checkKeys 检查命令中的key
+func checkKeys(keys []string) error {
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func respPing(w *respWriter, args []string) {
+	switch len(args) {
+	case 1:
+		w.writeSimple("PONG")
+	case 2:
+		w.writeBulk(args[1])
+	default:
+		w.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func respGet(w *respWriter, args []string) {
+	if err := checkKeys(args[1:]); err != nil {
+		w.writeErr(err)
+		return
+	}
+	value, ok, err := getKV(args[1])
+	switch {
+	case err != nil:
+		w.writeErr(err)
+	case !ok:
+		w.writeNull()
+	default:
+		w.writeBulk(value)
+	}
+}
+
+// respSet SET key value [EX seconds|PX milliseconds] [NX|XX]
+func respSet(w *respWriter, args []string) {
+	key, value := args[1], args[2]
+	var (
+		m      meta
+		nx, xx bool
+		expire bool
+	)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "nx" && !xx:
+			nx = true
+		case opt == "xx" && !nx:
+			xx = true
+		case (opt == "ex" || opt == "px") && !expire && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			unit := int64(1)
+			if opt == "ex" {
+				unit = 1000
+			}
+			now := nowMs()
+			if err != nil || n <= 0 || n > (1<<63-1-now)/unit {
+				w.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			m.deadline, expire = now+n*unit, true
+		default:
+			w.writeError("ERR syntax error")
+			return
+		}
+	}
+	if err := checkKeys([]string{key}); err != nil {
+		w.writeErr(err)
+		return
+	}
+	var written bool
+	err := update(func(txn *xdb.Txn) error {
+		old, err := readItem(txn, key)
+		if err != nil {
+			return err
+		}
+		if written = !(nx && old.exists) && !(xx && !old.exists); !written {
+			return nil
+		}
+		return writeItem(txn, key, old, &value, m)
+	})
+	switch {
+	case err != nil:
+		w.writeErr(err)
+	case !written:
+		w.writeNull()
+	default:
+		w.writeSimple("OK")
+	}
+}
+
+func respDel(w *respWriter, args []string) {
+	if err := checkKeys(args[1:]); err != nil {
+		w.writeErr(err)
+		return
+	}
+	var n int64
+	for _, key := range args[1:] {
+		existed, err := delKV(key)
+		if err != nil {
+			w.writeErr(err)
+			return
+		}
+		if existed {
+			n++
+		}
+	}
+	w.writeInt(n)
+}
+
+func respExists(w *respWriter, args []string) {
+	if err := checkKeys(args[1:]); err != nil {
+		w.writeErr(err)
+		return
+	}
+	var n int64
+	for _, key := range args[1:] {
+		_, ok, err := getKV(key)
+		if err != nil {
+			w.writeErr(err)
+			return
+		}
+		if ok {
+			n++
+		}
+	}
+	w.writeInt(n)
+}
+
+func respKeys(w *respWriter, args []string) {
+	keys, err := liveKeys("")
+	if err != nil {
+		w.writeErr(err)
+		return
+	}
+	matched := make([]string, 0)
+	for _, key := range keys {
+		if matchGlob(args[1], key) {
+			matched = append(matched, key)
+		}
+	}
+	w.writeArray(len(matched))
+	for _, key := range matched {
+		w.writeBulk(key)
+	}
+}
+
+// hashKeys 计算key的哈希值，按哈希值排序
+func hashKeys(keys []string) []hashedKey {
+	hashed := make([]hashedKey, 0, len(keys))
+	for _, key := range keys {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		hashed = append(hashed, hashedKey{h.Sum64(), key})
+	}
+	sort.Slice(hashed, func(i, j int) bool {
+		return hashed[i].hash < hashed[j].hash || (hashed[i].hash == hashed[j].hash && hashed[i].key < hashed[j].key)
+	})
+	return hashed
+}
+
+// respScan SCAN cursor [MATCH pattern] [COUNT count]
+func respScan(w *respWriter, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.writeError("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", DefaultScanCount
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "match" && i+1 < len(args):
+			i++
+			pattern = args[i]
+		case opt == "count" && i+1 < len(args):
+			i++
+			if count, err = strconv.Atoi(args[i]); err != nil || count <= 0 {
+				w.writeError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.writeError("ERR syntax error")
+			return
+		}
+	}
+	if cursor == 0 || w.scanKeys == nil {
+		keys, err := liveKeys("")
+		if err != nil {
+			w.writeErr(err)
+			return
+		}
+		w.scanKeys = hashKeys(keys)
+	}
+	hashed := w.scanKeys
+	i := sort.Search(len(hashed), func(i int) bool { return hashed[i].hash >= cursor })
+	matched := make([]string, 0)
+	// 哈希值相同的key在同一次调用中返回，保证游标可以区分已返回和未返回的key
+	for n := 0; i < len(hashed) && (n < count || hashed[i].hash == hashed[i-1].hash); i, n = i+1, n+1 {
+		if matchGlob(pattern, hashed[i].key) {
+			matched = append(matched, hashed[i].key)
+		}
+	}
+	next := uint64(0)
+	if i < len(hashed) {
+		next = hashed[i].hash
+	} else {
+		w.scanKeys = nil
+	}
+	w.writeArray(2)
+	w.writeBulk(strconv.FormatUint(next, 10))
+	w.writeArray(len(matched))
+	for _, key := range matched {
+		w.writeBulk(key)
+	}
+}
+
+func respMGet(w *respWriter, args []string) {
+	values := make([]*string, 0, len(args)-1)
+	for _, key := range args[1:] {
+		// 不合法的key不可能存在
+		if checkKey(key) != nil {
+			values = append(values, nil)
+			continue
+		}
+		value, ok, err := getKV(key)
+		if err != nil {
+			w.writeErr(err)
+			return
+		}
+		if !ok {
+			values = append(values, nil)
+			continue
+		}
+		values = append(values, &value)
+	}
+	w.writeArray(len(values))
+	for _, value := range values {
+		if value == nil {
+			w.writeNull()
+			continue
+		}
+		w.writeBulk(*value)
+	}
+}
+
+func respMSet(w *respWriter, args []string) {
+	if len(args)%2 != 1 {
+		w.writeError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := checkKeys(args[i : i+1]); err != nil {
+			w.writeErr(err)
+			return
+		}
+	}
+	err := update(func(txn *xdb.Txn) error {
+		for i := 1; i < len(args); i += 2 {
+			old, err := readItem(txn, args[i])
+			if err != nil {
+				return err
+			}
+			if err = writeItem(txn, args[i], old, &args[i+1], meta{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		w.writeErr(err)
+		return
+	}
+	w.writeSimple("OK")
+}
+
+// respIncr 将key的值加1，key不存在时视为0；保留key的过期时间
+func respIncr(w *respWriter, args []string) {
+	key := args[1]
+	if err := checkKeys(args[1:]); err != nil {
+		w.writeErr(err)
+		return
+	}
+	var n int64
+	err := update(func(txn *xdb.Txn) error {
+		old, err := readItem(txn, key)
+		if err != nil {
+			return err
+		}
+		n = 0
+		if old.exists {
+			if n, err = strconv.ParseInt(old.value, 10, 64); err != nil {
+				return errors.New("value is not an integer or out of range")
+			}
+		}
+		if n == 1<<63-1 {
+			return errors.New("increment or decrement would overflow")
+		}
+		n++
+		value := strconv.FormatInt(n, 10)
+		return writeItem(txn, key, old, &value, old.meta)
+	})
+	if err != nil {
+		w.writeErr(err)
+		return
+	}
+	w.writeInt(n)
+}
+
+// matchGlob 按Redis的glob规则判断s是否匹配pattern：*匹配任意字符串，?匹配任意一个字符，[...]匹配字符集合(支持^取反和a-z范围)，\转义
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var ok bool
+			if ok, pattern = matchClass(pattern[1:], s[0]); !ok {
+				return false
+			}
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass 判断c是否匹配字符集合，pattern为'['之后的部分；返回是否匹配及字符集合之后的pattern，缺少']'时字符集合到pattern末尾结束
+func matchClass(pattern string, c byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			match = match || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || (c >= lo && c <= hi)
+			pattern = pattern[3:]
+		default:
+			match = match || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return match != not, pattern
+}
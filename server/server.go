@@ -0,0 +1,29 @@
+// Package server 通过网络协议(HTTP、Redis RESP、memcached文本协议)对外提供xdb的键值接口，调用方需要先通过xdb.Open打开数据库
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/CatchTheDog/xdb"
+)
+
+// Server 网络服务，Shutdown只停止服务，不关闭数据库
+type Server interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// Shutdown 停止全部服务，等待正在处理的请求完成后关闭数据库
+func Shutdown(ctx context.Context, srvs ...Server) error {
+	var firstErr error
+	for _, srv := range srvs {
+		if err := srv.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := xdb.Close(); err != nil {
+		return fmt.Errorf("close db error: %v", err)
+	}
+	return firstErr
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errProtocol = errors.New("Protocol error") // 请求不符合协议格式
+
+// tcpServer 基于TCP文本协议的服务：为每个连接启动一个goroutine执行handler；
+// 关闭时停止接收新的连接，唤醒阻塞在读取请求上的连接，连接执行完当前命令后退出
+type tcpServer struct {
+	addr    string
+	handler func(conn net.Conn) // 处理一个连接上的请求，每条命令执行后通过closing判断是否需要退出
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{} // 正在处理的连接
+	closed  bool
+	stopCh  chan struct{} // 服务停止时关闭
+	wg      sync.WaitGroup
+}
+
+// newTCPServer 创建监听addr的服务
+func newTCPServer(addr string, handler func(conn net.Conn)) *tcpServer {
+	return &tcpServer{addr: addr, handler: handler, conns: make(map[net.Conn]struct{}), stopCh: make(chan struct{})}
+}
+
+// ListenAndServe 开始监听并处理请求，Shutdown之后返回http.ErrServerClosed
+func (s *tcpServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve 在ln上接收连接并处理请求，Shutdown之后返回http.ErrServerClosed
+func (s *tcpServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	go runSweeper(s.stopCh)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.closing() {
+				return http.ErrServerClosed
+			}
+			return fmt.Errorf("accept connection error: %v", err)
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn 处理一个连接，返回时关闭连接
+func (s *tcpServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	s.handler(conn)
+}
+
+// closing 服务是否正在关闭
+func (s *tcpServer) closing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Shutdown 停止接收新的连接，等待正在执行的命令完成后关闭全部连接；ctx结束时直接关闭连接
+func (s *tcpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stopCh)
+		if s.ln != nil {
+			s.ln.Close()
+		}
+		// 唤醒阻塞在读取请求上的连接，连接执行完当前命令后退出
+		for conn := range s.conns {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// readLine 读取一行，去除行尾的CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) > MaxBodySize {
+		return "", fmt.Errorf("%w: too big request", errProtocol)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
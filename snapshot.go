@@ -0,0 +1,164 @@
+package xdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DBSnapshot 数据库在某一序列号时刻的只读视图，通过Snapshot创建，使用完毕后需要调用Release释放
+// 快照持有创建时刻内存索引的副本，之后的写入、段合并和blob文件垃圾回收对快照不可见；
+// 快照引用的数据文件在快照释放之前不会被删除
+type DBSnapshot struct {
+	engine   *DBEngine          // 数据库引擎
+	seq      uint64             // 快照时刻的最大序列号
+	gen      uint64             // 快照编号，用于判断延迟删除的数据文件是否仍被快照引用
+	memIdx   map[string]MemIdxV // 快照时刻的内存索引副本
+	released bool               // 快照是否已释放，由engine.snapMu保护
+}
+
+// pendingDel 等待快照释放后删除的数据文件
+type pendingDel struct {
+	fNames []string // 数据文件名称
+	gen    uint64   // 文件从MANIFEST中移除时的快照编号，编号不大于gen的快照仍可能引用这些文件
+}
+
+// Snapshot 创建当前时刻的只读快照；快照需要复制完整的内存索引
+// 数据库未打开或已关闭时返回已释放的快照，读取时返回ErrSnapshotReleased
+func Snapshot() *DBSnapshot {
+	engine := dbEngine
+	if engine.checkOpen() != nil {
+		if engine == nil {
+			engine = &DBEngine{}
+		}
+		return &DBSnapshot{engine: engine, released: true}
+	}
+	engine.segFMu.Lock() // 阻止写入，保证快照中的索引与序列号一致
+	defer engine.segFMu.Unlock()
+	engine.memIdxMu.RLock()
+	memIdx := make(map[string]MemIdxV, len(engine.memIdx))
+	for k, v := range engine.memIdx {
+		memIdx[k] = v
+	}
+	engine.memIdxMu.RUnlock()
+	engine.snapMu.Lock()
+	defer engine.snapMu.Unlock()
+	engine.snapGen++
+	snap := &DBSnapshot{engine: engine, seq: engine.seq, gen: engine.snapGen, memIdx: memIdx}
+	engine.snaps[snap.gen] = snap
+	return snap
+}
+
+// Seq 返回快照时刻的最大序列号
+func (snap *DBSnapshot) Seq() uint64 {
+	return snap.seq
+}
+
+// Get 从快照中查找key对应的value；key不存在时返回空字符串
+func (snap *DBSnapshot) Get(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("%s", "idxK can not be empty")
+	}
+	if snap.isReleased() {
+		return "", ErrSnapshotReleased
+	}
+	indexValue, ok := snap.memIdx[key]
+	if !ok {
+		return "", nil
+	}
+	return snap.engine.seekKey(key, indexValue)
+}
+
+// Keys 按key的字典序返回快照中所有以prefix开头的key
+func (snap *DBSnapshot) Keys(prefix string) []string {
+	keys := make([]string, 0)
+	for k := range snap.memIdx {
+		if strings.HasPrefix(k, prefix) && (!isInternalKey(k) || isInternalKey(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ForEach 按key的字典序遍历快照中所有以prefix开头的键值对，fn返回false时停止遍历
+func (snap *DBSnapshot) ForEach(prefix string, fn func(key, value string) bool) error {
+	for _, key := range snap.Keys(prefix) {
+		if snap.isReleased() {
+			return ErrSnapshotReleased
+		}
+		value, err := snap.engine.seekKey(key, snap.memIdx[key])
+		if err != nil {
+			return fmt.Errorf("idxK: %s, read value error: %v", key, err)
+		}
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Release 释放快照，删除只被已释放快照引用的数据文件；重复调用无副作用
+func (snap *DBSnapshot) Release() {
+	engine := snap.engine
+	engine.snapMu.Lock()
+	defer engine.snapMu.Unlock()
+	if snap.released {
+		return
+	}
+	snap.released = true
+	delete(engine.snaps, snap.gen)
+	engine.removePendingFs()
+}
+
+// releaseSnaps 释放所有尚未释放的快照(引擎关闭时使用)，并删除全部等待删除的数据文件
+func (engine *DBEngine) releaseSnaps() {
+	engine.snapMu.Lock()
+	defer engine.snapMu.Unlock()
+	for gen, snap := range engine.snaps {
+		snap.released = true
+		delete(engine.snaps, gen)
+	}
+	engine.removePendingFs()
+}
+
+// isReleased 判断快照是否已释放
+func (snap *DBSnapshot) isReleased() bool {
+	snap.engine.snapMu.Lock()
+	defer snap.engine.snapMu.Unlock()
+	return snap.released
+}
+
+// removeDataFs 删除已从MANIFEST中移除的数据文件；若存在可能引用这些文件的快照，延迟到快照释放后删除
+func (engine *DBEngine) removeDataFs(fNames []string) {
+	engine.snapMu.Lock()
+	defer engine.snapMu.Unlock()
+	engine.pendingDels = append(engine.pendingDels, pendingDel{fNames: fNames, gen: engine.snapGen})
+	engine.removePendingFs()
+}
+
+// removePendingFs 删除不再被任何快照引用的数据文件，调用方需持有snapMu
+func (engine *DBEngine) removePendingFs() {
+	minGen := engine.snapGen + 1 // 仍打开的快照中的最小编号
+	for gen := range engine.snaps {
+		if gen < minGen {
+			minGen = gen
+		}
+	}
+	pending := engine.pendingDels[:0]
+	for _, del := range engine.pendingDels {
+		if del.gen >= minGen {
+			pending = append(pending, del)
+			continue
+		}
+		for _, fName := range del.fNames {
+			if err := os.Remove(path.Join(engine.dataDir, fName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slogger.Errorf("delete file: %s error: %v", fName, err)
+			}
+		}
+	}
+	engine.pendingDels = pending
+}
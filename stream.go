@@ -0,0 +1,159 @@
+package xdb
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// PutReader 从r中读取size字节作为key的value保存到数据库中
+// value 超过blob阈值且未启用压缩、加密时，value 直接流式写入单独的blob文件，不会完整读入内存；
+// 否则(压缩、加密需要完整的value)读取完整的value后按Put写入
+func PutReader(key string, r io.Reader, size int64) error {
+	if key == "" || size <= 0 {
+		return fmt.Errorf("idxK, size can not be empty, idxK: %s, size: %d", key, size)
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return err
+	}
+	if size > MaxBlobValSize {
+		return fmt.Errorf("idxK: %s, value size: %d exceeds limit: %d", key, size, int64(MaxBlobValSize))
+	}
+	if size <= int64(dbEngine.blobThreshold) || dbEngine.codec.ID() != NoneCodec.ID() || dbEngine.crypt != nil {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("idxK: %s, read value error: %v", key, err)
+		}
+		return Put(key, string(buf))
+	}
+	return dbEngine.putStream(key, r, size)
+}
+
+// GetReader 返回读取key对应value的io.ReadCloser，使用完毕后需要Close；与Query一致，key不存在时返回空的reader
+// 未压缩、未加密的blob value直接从blob文件中流式读取，其他value读取到内存后返回
+func GetReader(key string) (io.ReadCloser, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%s", "idxK can not be empty")
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return nil, err
+	}
+	indexValue, ok := dbEngine.getMemIdx(key)
+	if !ok {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if indexValue.kind == KindBlob && indexValue.codec == NoneCodec.ID() && indexValue.keyID == 0 {
+		return dbEngine.openBlobReader(indexValue)
+	}
+	value, err := dbEngine.seekKey(key, indexValue)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(value)), nil
+}
+
+// blobReader 读取blob文件中的一段value
+type blobReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+// Close 关闭blob文件
+func (r *blobReader) Close() error {
+	return r.f.Close()
+}
+
+// openBlobReader 读取KindBlob记录中的blob指针，打开指针指向的blob文件
+// blob 文件被垃圾回收删除后，已打开的文件仍可以继续读取
+func (engine *DBEngine) openBlobReader(index MemIdxV) (io.ReadCloser, error) {
+	ptr, err := engine.readBlobPtr(index)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path.Join(engine.dataDir, ptr.fName), os.O_RDONLY, FileMode)
+	if err != nil {
+		return nil, fmt.Errorf("open blob file: %s error: %v", ptr.fName, err)
+	}
+	return &blobReader{SectionReader: io.NewSectionReader(f, ptr.valops, int64(ptr.valsz)), f: f}, nil
+}
+
+// putStream 将value流式写入一个新的blob文件，然后在段文件中写入指向该blob文件的指针记录
+// 持有段文件锁创建blob文件，与活跃blob文件的切换互斥；写入value期间不持有段文件锁，
+// 序列号在写入指针记录时分配，保证序列号与段文件中记录的写入顺序一致；blob记录头部的seq为0
+func (engine *DBEngine) putStream(key string, r io.Reader, size int64) error {
+	engine.segFMu.Lock()
+	blobFName, err := engine.newDataF(DataFNameFormat, BlobFNamePrefix, time.Now().UnixNano())
+	engine.segFMu.Unlock()
+	if err != nil {
+		return err
+	}
+	valops, err := engine.writeBlobStream(blobFName, key, r, size)
+	if err != nil {
+		os.Remove(path.Join(engine.dataDir, blobFName))
+		return fmt.Errorf("idxK: %s, write blob file error: %v", key, err)
+	}
+	ptr, err := encodeBlobPtr(blobPtr{fName: blobFName, valops: valops, valsz: int(size)})
+	if err != nil {
+		return err
+	}
+	// blob 文件记录到MANIFEST后，由blob文件垃圾回收负责清理；持有段合并锁，保证写入指针记录之前不会被垃圾回收
+	engine.segMergeMu.Lock()
+	defer engine.segMergeMu.Unlock()
+	if err = engine.manifest.commit([]string{blobFName}, nil); err != nil {
+		return fmt.Errorf("record blob file: %s to manifest error: %v", blobFName, err)
+	}
+	seg := &Segment{
+		value: ptr,
+		Hint: Hint{
+			key:   key,
+			keysz: len(key),
+			val: val{
+				tm:    time.Now().UnixNano(),
+				kind:  KindBlob,
+				valsz: len(ptr),
+			},
+		},
+	}
+	return engine.appendSeg(seg)
+}
+
+// writeBlobStream 将一条blob记录流式写入blob文件并刷盘，返回value在blob文件中的位置
+// 记录头部的CRC校验值在value写入完成后回填
+func (engine *DBEngine) writeBlobStream(blobFName string, key string, r io.Reader, size int64) (int64, error) {
+	f, err := os.OpenFile(path.Join(engine.dataDir, blobFName), os.O_WRONLY, FileMode)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	start, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	prefix := fmt.Sprintf(BlobFormat, uint64(0), NoneCodec.ID(), 0, len(key), size, key, "")
+	hash := crc32.NewIEEE()
+	hash.Write([]byte(prefix))
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%08x%s", 0, prefix)
+	if _, err = io.CopyN(io.MultiWriter(w, hash), r, size); err != nil {
+		return 0, err
+	}
+	w.WriteByte(DataDelimiterByte)
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err = f.WriteAt([]byte(fmt.Sprintf("%08x", hash.Sum32())), start); err != nil {
+		return 0, err
+	}
+	if err = f.Sync(); err != nil {
+		return 0, err
+	}
+	return start + int64(8+len(prefix)), nil
+}
@@ -0,0 +1,1415 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CatchTheDog/xdb"
+	"github.com/CatchTheDog/xdb/server"
+)
+
+func TestOpenLocked(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := xdb.Open(dir); !errors.Is(err, xdb.ErrLocked) {
+		t.Fatalf("open locked dir, want ErrLocked, got: %v", err)
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	if err := xdb.Open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	xdb.Put("k", "v")
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := xdb.Put("k", "v2"); !errors.Is(err, xdb.ErrClosed) {
+		t.Fatalf("put after close, want ErrClosed, got: %v", err)
+	}
+	if _, err := xdb.Query("k"); !errors.Is(err, xdb.ErrClosed) {
+		t.Fatalf("query after close, want ErrClosed, got: %v", err)
+	}
+	if err := xdb.DropBucket("b"); !errors.Is(err, xdb.ErrClosed) {
+		t.Fatalf("drop bucket after close, want ErrClosed, got: %v", err)
+	}
+	if err := xdb.DropIndex("i"); !errors.Is(err, xdb.ErrClosed) {
+		t.Fatalf("drop index after close, want ErrClosed, got: %v", err)
+	}
+	if err := xdb.Begin().Commit(); err != nil {
+		t.Fatalf("commit empty txn after close: %v", err)
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close twice: %v", err)
+	}
+}
+
+// segRecord 按段文件格式编码一条未压缩、未加密的记录，value为空时为删除记录
+func segRecord(seq uint64, key, value string) string {
+	return segRecordAt(seq, time.Now().UnixNano(), key, value)
+}
+
+// segRecordAt 同segRecord，记录的写入时间为tm
+func segRecordAt(seq uint64, tm int64, key, value string) string {
+	data := fmt.Sprintf("%016x%016x%02x%02x%08x%02x%03x%s%s", seq, tm, 0, 0, 0, len(key), len(value), key, value)
+	return fmt.Sprintf("%08x%s\n", crc32.ChecksumIEEE([]byte(data)), data)
+}
+
+// writeSegF 在dir中写入时间戳为tm的段文件，返回文件路径
+func writeSegF(t *testing.T, dir string, tm int64, recs ...string) string {
+	fPath := filepath.Join(dir, fmt.Sprintf("seg_%d", tm))
+	if err := os.WriteFile(fPath, []byte("XSEG0001\n"+strings.Join(recs, "")), 0644); err != nil {
+		t.Fatalf("write segment file: %v", err)
+	}
+	return fPath
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := xdb.Put("k1", "v1"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// MANIFEST 中没有记录的文件(如段合并中断遗留的文件)被忽略
+	stray := writeSegF(t, dir, time.Now().UnixNano(), segRecord(99, "k1", "v0"))
+	// 写入中断导致的残缺MANIFEST记录被丢弃
+	f, err := os.OpenFile(filepath.Join(dir, "MANIFEST"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open manifest: %v", err)
+	}
+	f.WriteString("00000000+seg_1\n")
+	f.Close()
+	os.Remove(filepath.Join(dir, "INDEX"))
+
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	if v, err := xdb.Query("k1"); err != nil || v != "v1" {
+		t.Fatalf("query k1, want: v1, got: %s, %v", v, err)
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Fatalf("want stray file kept: %v", err)
+	}
+}
+
+func TestCorruptedHint(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	xdb.Put("k1", "v1")
+	xdb.Put("k2", "v2")
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 修改hint文件中的key，使记录校验失败；删除索引快照，从hint文件/段文件重建索引
+	hintFs, _ := filepath.Glob(filepath.Join(dir, "hint_*"))
+	if len(hintFs) != 1 {
+		t.Fatalf("want 1 hint file, got: %v", hintFs)
+	}
+	data, err := os.ReadFile(hintFs[0])
+	if err != nil {
+		t.Fatalf("read hint file: %v", err)
+	}
+	if err = os.WriteFile(hintFs[0], bytes.Replace(data, []byte("k2"), []byte("k9"), 1), 0644); err != nil {
+		t.Fatalf("write hint file: %v", err)
+	}
+	os.Remove(filepath.Join(dir, "INDEX"))
+
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	for k, want := range map[string]string{"k1": "v1", "k2": "v2", "k9": ""} {
+		if v, err := xdb.Query(k); err != nil || v != want {
+			t.Fatalf("query %s, want: %q, got: %q, %v", k, want, v, err)
+		}
+	}
+}
+
+func TestParallelRebuild(t *testing.T) {
+	dir := t.TempDir()
+	// 多个段文件并发解析，较新段文件中的删除记录不能被较旧段文件中的写入覆盖
+	tm := time.Now().UnixNano()
+	for i := 1; i <= 10; i++ {
+		recs := []string{segRecord(uint64(i*2-1), "a", strconv.Itoa(i)), segRecord(uint64(i*2), "b", strconv.Itoa(i))}
+		if i == 10 {
+			recs[0] = segRecord(uint64(i*2-1), "a", "")
+		}
+		writeSegF(t, dir, tm+int64(i), recs...)
+	}
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	for k, want := range map[string]string{"a": "", "b": "10"} {
+		if v, err := xdb.Query(k); err != nil || v != want {
+			t.Fatalf("query %s, want: %q, got: %q, %v", k, want, v, err)
+		}
+	}
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	xdb.Put("k1", "v1")
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 清空hint文件中的记录：从hint文件重建索引时找不到k1，只有加载索引快照时才能找到
+	hintFs, _ := filepath.Glob(filepath.Join(dir, "hint_*"))
+	if len(hintFs) != 1 {
+		t.Fatalf("want 1 hint file, got: %v", hintFs)
+	}
+	if err := os.WriteFile(hintFs[0], []byte("XHNT0001\n"), 0644); err != nil {
+		t.Fatalf("write hint file: %v", err)
+	}
+	// 在段文件末尾追加快照之后的记录，启动时回放
+	segFs, _ := filepath.Glob(filepath.Join(dir, "seg_*"))
+	f, err := os.OpenFile(segFs[0], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open segment file: %v", err)
+	}
+	f.WriteString(segRecord(2, "k2", "v2"))
+	f.Close()
+
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	for k, want := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if v, err := xdb.Query(k); err != nil || v != want {
+			t.Fatalf("query %s, want: %s, got: %s, %v", k, want, v, err)
+		}
+	}
+}
+
+func TestSeqOrder(t *testing.T) {
+	dir := t.TempDir()
+	// 记录的先后以序列号为准：写入时间相同或回退(时钟回拨)时，序列号较大的记录有效
+	tm := time.Now().UnixNano()
+	writeSegF(t, dir, tm,
+		segRecordAt(1, tm, "a", "1"), segRecordAt(2, tm, "a", "2"),
+		segRecordAt(3, tm, "b", "1"), segRecordAt(4, tm-int64(time.Hour), "b", "2"))
+	writeSegF(t, dir, tm+1, segRecordAt(5, tm-int64(time.Hour), "a", "3"))
+	for i, want := range []uint64{6, 7} {
+		if err := xdb.Open(dir); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		for k, v := range map[string]string{"a": "3", "b": "2"} {
+			if got, err := xdb.Query(k); err != nil || got != v {
+				t.Fatalf("round %d, query %s, want: %s, got: %s, %v", i, k, v, got, err)
+			}
+		}
+		// 重启后序列号从数据文件中的最大值继续递增
+		xdb.Put("c", strconv.Itoa(i))
+		it, err := xdb.ChangesSince(want - 1)
+		if err != nil {
+			t.Fatalf("changes since: %v", err)
+		}
+		if !it.Next() || it.Change().Key != "c" || it.Change().Seq != want || it.Next() {
+			t.Fatalf("round %d, want change of c with seq %d, got: %+v", i, want, it.Change())
+		}
+		it.Close()
+		if err := xdb.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+func TestTornWriteRecovery(t *testing.T) {
+	// 子进程写入后不调用Close直接退出，模拟进程崩溃
+	if dir := os.Getenv("XDB_CRASH_DIR"); dir != "" {
+		if err := xdb.Open(dir); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if err := xdb.Put("k1", "v1"); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		os.Exit(0)
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTornWriteRecovery$")
+	cmd.Env = append(os.Environ(), "XDB_CRASH_DIR="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("crash process: %v, output: %s", err, out)
+	}
+	// 崩溃时段文件末尾存在一条残缺记录
+	segFs, _ := filepath.Glob(filepath.Join(dir, "seg_*"))
+	if len(segFs) != 1 {
+		t.Fatalf("want 1 segment file, got: %v", segFs)
+	}
+	if hintFs, _ := filepath.Glob(filepath.Join(dir, "hint_*")); len(hintFs) != 0 {
+		t.Fatalf("want no hint file after crash, got: %v", hintFs)
+	}
+	torn := "1234abcd0000017"
+	f, err := os.OpenFile(segFs[0], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open segment file: %v", err)
+	}
+	f.WriteString(torn)
+	f.Close()
+
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	recovery := xdb.Recovered()
+	if recovery == nil || recovery.TruncatedBytes != int64(len(torn)) {
+		t.Fatalf("want %d bytes truncated, got: %+v", len(torn), recovery)
+	}
+	if err := xdb.Put("k2", "v2"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	for k, want := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if v, err := xdb.Query(k); err != nil || v != want {
+			t.Fatalf("query %s, want: %s, got: %s, %v", k, want, v, err)
+		}
+	}
+}
+
+func TestActiveSegmentReopen(t *testing.T) {
+	dir := t.TempDir()
+	glob := func(pattern string) []string {
+		fs, _ := filepath.Glob(filepath.Join(dir, pattern))
+		return fs
+	}
+	for i, key := range []string{"k1", "k2"} {
+		if err := xdb.Open(dir); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if err := xdb.Put(key, "v"); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		// 未达到大小上限的段文件继续追加写入，首次写入前删除其hint文件
+		if hintFs := glob("hint_*"); len(hintFs) != 0 {
+			t.Fatalf("round %d, want hint file removed after append, got: %v", i, hintFs)
+		}
+		if err := xdb.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if segFs, hintFs := glob("seg_*"), glob("hint_*"); len(segFs) != 1 || len(hintFs) != 1 {
+			t.Fatalf("round %d, want 1 segment and 1 hint file after close, got: %v, %v", i, segFs, hintFs)
+		}
+	}
+	// 删除索引快照，从重新生成的hint文件加载索引
+	os.Remove(filepath.Join(dir, "INDEX"))
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	for _, k := range []string{"k1", "k2"} {
+		if v, err := xdb.Query(k); err != nil || v != "v" {
+			t.Fatalf("query %s, want: v, got: %s, %v", k, v, err)
+		}
+	}
+	// 段文件切换后为冻结的段文件生成hint文件
+	value := strings.Repeat("x", 1000)
+	for i := 0; len(glob("seg_*")) < 2; i++ {
+		if err := xdb.Put(fmt.Sprintf("r%d", i), value); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	frozen := glob("seg_*")[0]
+	hintF := filepath.Join(dir, "hint_"+strings.TrimPrefix(filepath.Base(frozen), "seg_"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(hintF); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want hint file for frozen segment: %s", frozen)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	value := strings.Repeat(`{"name":"xdb","tags":["kv","bitcask"]}`, 20)
+	for i := 0; i < 2; i++ {
+		if err := xdb.OpenWithOptions(xdb.Options{DataDir: dir, Codec: xdb.GzipCodec}); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if i == 0 {
+			if err := xdb.Put("doc", value); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+		}
+		if v, err := xdb.Query("doc"); err != nil || v != value {
+			t.Fatalf("query doc, want: %s, got: %s, %v", value, v, err)
+		}
+		if err := xdb.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+	segFs, _ := filepath.Glob(filepath.Join(dir, "seg_*"))
+	if len(segFs) != 1 {
+		t.Fatalf("want 1 segment file, got: %v", segFs)
+	}
+	info, err := os.Stat(segFs[0])
+	if err != nil {
+		t.Fatalf("stat segment file: %v", err)
+	}
+	if info.Size() >= int64(len(value)) {
+		t.Fatalf("want compressed segment file smaller than %d bytes, got: %d", len(value), info.Size())
+	}
+}
+
+// upperCodec 测试用自定义编解码器，使用与内置编解码器相同的标识
+type upperCodec struct{}
+
+func (upperCodec) ID() uint8                         { return xdb.GzipCodec.ID() }
+func (upperCodec) Encode(src []byte) ([]byte, error) { return bytes.ToUpper(src), nil }
+func (upperCodec) Decode(src []byte) ([]byte, error) { return bytes.ToLower(src), nil }
+
+func TestCodecIDCollision(t *testing.T) {
+	if err := xdb.OpenWithOptions(xdb.Options{DataDir: t.TempDir(), Codec: upperCodec{}}); err == nil {
+		xdb.Close()
+		t.Fatal("open with codec id of a built-in codec, want error")
+	}
+}
+
+// staticKeys 测试用密钥提供者，cur为当前密钥标识
+type staticKeys struct {
+	cur  uint32
+	keys map[uint32][]byte
+}
+
+func (s *staticKeys) CurrentKey() (uint32, []byte, error) { return s.cur, s.keys[s.cur], nil }
+
+func (s *staticKeys) Key(id uint32) ([]byte, error) {
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	}
+	return nil, errors.New("unknown key")
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	kp := &staticKeys{cur: 1, keys: map[uint32][]byte{
+		1: []byte(strings.Repeat("a", 32)),
+		2: []byte(strings.Repeat("b", 32)),
+	}}
+	for i := 0; i < 2; i++ {
+		if err := xdb.OpenWithOptions(xdb.Options{DataDir: dir, KeyProvider: kp}); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if i == 0 {
+			if err := xdb.Put("secret-key", "secret-value"); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+		}
+		if v, err := xdb.Query("secret-key"); err != nil || v != "secret-value" {
+			t.Fatalf("query secret-key, want: secret-value, got: %s, %v", v, err)
+		}
+		if err := xdb.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		// 密钥轮换后，旧数据仍可使用旧密钥解密
+		kp.cur = 2
+	}
+	fs, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, f := range fs {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", f, err)
+		}
+		if strings.Contains(string(data), "secret") {
+			t.Fatalf("plaintext found in %s", f)
+		}
+	}
+	// value的密文与key绑定，复制到其他key的记录中时解密失败
+	dir = t.TempDir()
+	if err := xdb.OpenWithOptions(xdb.Options{DataDir: dir, KeyProvider: kp}); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	xdb.Put("a", "value-a")
+	xdb.Put("b", "value-b")
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	segFs, _ := filepath.Glob(filepath.Join(dir, "seg_*"))
+	data, _ := os.ReadFile(segFs[0])
+	recs := strings.Split(strings.TrimSuffix(string(data[9:]), "\n"), "\n")
+	valsz, _ := strconv.ParseInt(recs[0][8+46:8+49], 16, 64)
+	recA := recs[0][8:len(recs[0])-int(valsz)] + recs[1][len(recs[1])-int(valsz):]
+	recs[0] = fmt.Sprintf("%08x%s", crc32.ChecksumIEEE([]byte(recA)), recA)
+	os.WriteFile(segFs[0], []byte(string(data[:9])+strings.Join(recs, "\n")+"\n"), 0644)
+	if err := xdb.OpenWithOptions(xdb.Options{DataDir: dir, KeyProvider: kp}); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	if v, err := xdb.Query("a"); err == nil {
+		t.Fatalf("query a with value moved from b, want error, got: %s", v)
+	}
+}
+
+func TestMigrateLegacyFormat(t *testing.T) {
+	dir := t.TempDir()
+	// 版本0 段文件：没有文件头，记录不包含seq、codec、keyID
+	var legacy string
+	for i, kv := range [][2]string{{"k1", "v1"}, {"k2", "v2"}, {"k1", "v3"}} {
+		rec := fmt.Sprintf("%016x%02x%03x%s%s", 1000+i, len(kv[0]), len(kv[1]), kv[0], kv[1])
+		legacy += fmt.Sprintf("%08x%s\n", crc32.ChecksumIEEE([]byte(rec)), rec)
+	}
+	segPath := filepath.Join(dir, "seg_1")
+	if err := os.WriteFile(segPath, []byte(legacy), 0644); err != nil {
+		t.Fatalf("write legacy segment: %v", err)
+	}
+	if err := xdb.Migrate(dir); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	data, err := os.ReadFile(segPath)
+	if err != nil || !strings.HasPrefix(string(data), fmt.Sprintf("%s%04x\n", xdb.SegFMagic, xdb.FormatVersion)) {
+		t.Fatalf("want segment file with header, got: %q, %v", data, err)
+	}
+	if err = xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	for k, want := range map[string]string{"k1": "v3", "k2": "v2"} {
+		if v, err := xdb.Query(k); err != nil || v != want {
+			t.Fatalf("query %s, want: %s, got: %s, %v", k, want, v, err)
+		}
+	}
+}
+
+func TestOpenUnsupportedVersion(t *testing.T) {
+	dir := t.TempDir()
+	header := fmt.Sprintf("%s%04x\n", xdb.SegFMagic, xdb.FormatVersion+1)
+	if err := os.WriteFile(filepath.Join(dir, "seg_1"), []byte(header), 0644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+	if err := xdb.Open(dir); !errors.Is(err, xdb.ErrUnsupportedVersion) {
+		t.Fatalf("want ErrUnsupportedVersion, got: %v", err)
+	}
+	// 打开失败时释放数据目录锁
+	if err := xdb.Migrate(dir); !errors.Is(err, xdb.ErrUnsupportedVersion) {
+		t.Fatalf("want ErrUnsupportedVersion, got: %v", err)
+	}
+}
+
+func TestBlobValues(t *testing.T) {
+	dir := t.TempDir()
+	value := strings.Repeat("0123456789", 1000)
+	for i := 0; i < 2; i++ {
+		if err := xdb.OpenWithOptions(xdb.Options{DataDir: dir, BlobThreshold: 128}); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if i == 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			events := xdb.Watch(ctx, "big")
+			if err := xdb.Put("big", value); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if event := <-events; event.Type != xdb.EventPut || event.Value != value {
+				t.Fatalf("want put event with blob value, got: %v, %d bytes", event.Type, len(event.Value))
+			}
+			cancel()
+			if err := xdb.Put("small", "v"); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+		}
+		for k, want := range map[string]string{"big": value, "small": "v"} {
+			if v, err := xdb.Query(k); err != nil || v != want {
+				t.Fatalf("query %s, want %d bytes, got: %d bytes, %v", k, len(want), len(v), err)
+			}
+		}
+		if err := xdb.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+	segFs, _ := filepath.Glob(filepath.Join(dir, "seg_*"))
+	blobFs, _ := filepath.Glob(filepath.Join(dir, "blob_*"))
+	if len(segFs) != 1 || len(blobFs) != 1 {
+		t.Fatalf("want 1 segment file and 1 blob file, got: %v, %v", segFs, blobFs)
+	}
+	info, err := os.Stat(segFs[0])
+	if err != nil || info.Size() >= int64(len(value)) {
+		t.Fatalf("want value stored outside segment file, got: %v, %v", info, err)
+	}
+}
+
+func TestBlobGC(t *testing.T) {
+	dir := t.TempDir()
+	opts := xdb.Options{DataDir: dir, BlobThreshold: 128}
+	if err := xdb.OpenWithOptions(opts); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	keep := strings.Repeat("k", 64<<10)
+	xdb.Put("keep", keep)
+	version := func() uint64 {
+		txn := xdb.Begin()
+		defer txn.Rollback()
+		_, seq, err := txn.GetVersion("keep")
+		if err != nil {
+			t.Fatalf("get version: %v", err)
+		}
+		return seq
+	}
+	seq := version()
+	blobFs, _ := filepath.Glob(filepath.Join(dir, "blob_*"))
+	events := xdb.Watch(context.Background(), "keep")
+	// 反复覆盖其他key，使第一个blob文件中的失效数据达到回收比例，垃圾回收将keep的value迁移到新的blob文件
+	for i := 0; i < 1000; i++ {
+		if _, err := os.Stat(blobFs[0]); os.IsNotExist(err) {
+			break
+		}
+		xdb.Put("churn", strings.Repeat(fmt.Sprint(i%10), 64<<10))
+		if i%100 == 99 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if _, err := os.Stat(blobFs[0]); !os.IsNotExist(err) {
+		t.Fatalf("want blob file: %s collected, got: %v", blobFs[0], err)
+	}
+	// 迁移不是新的写入：版本号不变，不产生订阅事件
+	select {
+	case event := <-events:
+		t.Fatalf("want no event for moved blob, got: %+v", event)
+	default:
+	}
+	if got := version(); got != seq {
+		t.Fatalf("version after blob gc, want: %d, got: %d", seq, got)
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 扫描段文件重建索引，序列号相同的记录以迁移后的指针记录为准
+	os.Remove(filepath.Join(dir, "INDEX"))
+	if err := xdb.OpenWithOptions(opts); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	if v, err := xdb.Query("keep"); err != nil || v != keep {
+		t.Fatalf("query keep after reopen, want %d bytes, got: %d bytes, %v", len(keep), len(v), err)
+	}
+	if got := version(); got != seq {
+		t.Fatalf("version after reopen, want: %d, got: %d", seq, got)
+	}
+}
+
+func TestStreamValues(t *testing.T) {
+	dir := t.TempDir()
+	// value 中可以包含空白字符
+	value := bytes.Repeat([]byte("line of artifact data\n"), 200000)
+	for i := 0; i < 2; i++ {
+		if err := xdb.Open(dir); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if i == 0 {
+			// 流式写入期间对同一key的写入先于指针记录写入，被流式写入覆盖
+			r := io.MultiReader(bytes.NewReader(value[:1]), readerFunc(func(p []byte) (int, error) {
+				xdb.Put("artifact", "inline")
+				return 0, io.EOF
+			}), bytes.NewReader(value[1:]))
+			if err := xdb.PutReader("artifact", r, int64(len(value))); err != nil {
+				t.Fatalf("put reader: %v", err)
+			}
+			it, err := xdb.ChangesSince(0)
+			if err != nil {
+				t.Fatalf("changes since: %v", err)
+			}
+			var seqs []uint64
+			for it.Next() {
+				seqs = append(seqs, it.Change().Seq)
+			}
+			it.Close()
+			if len(seqs) != 2 || seqs[0] >= seqs[1] {
+				t.Fatalf("want 2 changes in seq order, got: %v", seqs)
+			}
+		}
+		r, err := xdb.GetReader("artifact")
+		if err != nil {
+			t.Fatalf("get reader: %v", err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("read artifact, want %d bytes, got: %d bytes, %v", len(value), len(got), err)
+		}
+		// 与Query一致，key不存在时返回空的value
+		if r, err = xdb.GetReader("missing"); err != nil {
+			t.Fatalf("get reader of missing key: %v", err)
+		}
+		got, err = io.ReadAll(r)
+		r.Close()
+		if err != nil || len(got) != 0 {
+			t.Fatalf("read missing key, want empty value, got: %q, %v", got, err)
+		}
+		if err := xdb.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	if err := xdb.Open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	for k, v := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if err := xdb.Put(k, v); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	snap := xdb.Snapshot()
+	xdb.Put("k1", "v1-new")
+	xdb.Remove("k2")
+	xdb.Put("k3", "v3")
+	got := make(map[string]string)
+	if err := snap.ForEach("k", func(k, v string) bool {
+		got[k] = v
+		return true
+	}); err != nil {
+		t.Fatalf("for each: %v", err)
+	}
+	if len(got) != 2 || got["k1"] != "v1" || got["k2"] != "v2" {
+		t.Fatalf("want snapshot view {k1:v1 k2:v2}, got: %v", got)
+	}
+	if v, _ := xdb.Query("k1"); v != "v1-new" {
+		t.Fatalf("query k1, want: v1-new, got: %s", v)
+	}
+	snap.Release()
+	if _, err := snap.Get("k1"); !errors.Is(err, xdb.ErrSnapshotReleased) {
+		t.Fatalf("get from released snapshot, want ErrSnapshotReleased, got: %v", err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	xdb.Put("a", "100")
+	xdb.Put("b", "0")
+	// 事务读取的key在提交前被修改，提交失败且写入不生效
+	txn := xdb.Begin()
+	if v, _ := txn.Get("a"); v != "100" {
+		t.Fatalf("txn get a, want: 100, got: %s", v)
+	}
+	txn.Put("a", "50")
+	xdb.Put("a", "90")
+	if err := txn.Commit(); !errors.Is(err, xdb.ErrConflict) {
+		t.Fatalf("commit, want ErrConflict, got: %v", err)
+	}
+	txn = xdb.Begin()
+	a, _ := txn.Get("a")
+	txn.Put("a", "40")
+	if v, _ := txn.Get("a"); v != "40" {
+		t.Fatalf("txn get a after put, want: 40, got: %s", v)
+	}
+	txn.Put("b", a)
+	txn.Delete("c")
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 重启后通过扫描段文件重建索引，批量写入仍然生效
+	os.Remove(filepath.Join(dir, "INDEX"))
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	for k, want := range map[string]string{"a": "40", "b": "90"} {
+		if v, err := xdb.Query(k); err != nil || v != want {
+			t.Fatalf("query %s, want: %s, got: %s, %v", k, want, v, err)
+		}
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	if err := xdb.Open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	if ok, err := xdb.PutIfAbsent("lease", "a"); !ok || err != nil {
+		t.Fatalf("put if absent, want ok, got: %v, %v", ok, err)
+	}
+	if ok, _ := xdb.PutIfAbsent("lease", "b"); ok {
+		t.Fatalf("put if absent on existing key, want not ok")
+	}
+	if ok, _ := xdb.CompareAndSwap("lease", "b", "c"); ok {
+		t.Fatalf("cas with stale old value, want not ok")
+	}
+	if ok, _ := xdb.CompareAndSwap("lease", "a", "c"); !ok {
+		t.Fatalf("cas, want ok")
+	}
+	if ok, _ := xdb.DeleteIfEquals("lease", "a"); ok {
+		t.Fatalf("delete if equals with stale value, want not ok")
+	}
+	if ok, _ := xdb.DeleteIfEquals("lease", "c"); !ok {
+		t.Fatalf("delete if equals, want ok")
+	}
+	if v, _ := xdb.Query("lease"); v != "" {
+		t.Fatalf("query deleted key, got: %s", v)
+	}
+	// 并发递增计数器，CAS 保证不丢失更新
+	xdb.Put("counter", "0")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; {
+				cur, _ := xdb.Query("counter")
+				var c int
+				fmt.Sscanf(cur, "%d", &c)
+				if ok, _ := xdb.CompareAndSwap("counter", cur, fmt.Sprint(c+1)); ok {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := xdb.Query("counter"); v != "400" {
+		t.Fatalf("counter, want: 400, got: %s", v)
+	}
+}
+
+// failingAppend 按StringAppend合并，fail为true时合并失败
+type failingAppend struct {
+	fail *atomic.Bool
+}
+
+func (f failingAppend) FullMerge(key, base string, exists bool, operands []string) (string, error) {
+	if f.fail.Load() {
+		return "", fmt.Errorf("idxK: %s, merge failed", key)
+	}
+	return xdb.StringAppend{Delimiter: ","}.FullMerge(key, base, exists, operands)
+}
+
+func TestMergeOperators(t *testing.T) {
+	fail := &atomic.Bool{}
+	xdb.RegisterMergeOperator("cnt:", xdb.Int64Add{})
+	xdb.RegisterMergeOperator("list:", xdb.StringAppend{Delimiter: ", "})
+	xdb.RegisterMergeOperator("fold:", failingAppend{fail: fail})
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	xdb.Put("cnt:a", "10")
+	for i := 0; i < 40; i++ {
+		if err := xdb.Merge("cnt:a", "1"); err != nil {
+			t.Fatalf("merge: %v", err)
+		}
+	}
+	xdb.Merge("cnt:b", "-3")
+	for _, item := range []string{"x", "y", "z"} {
+		xdb.Merge("list:l", item)
+	}
+	if err := xdb.Merge("other", "1"); err == nil {
+		t.Fatalf("merge key without operator, want error")
+	}
+	if err := xdb.Merge("cnt:a", "abc"); err == nil {
+		t.Fatalf("merge bad operand, want error")
+	}
+	want := map[string]string{"cnt:a": "50", "cnt:b": "-3", "list:l": "x, y, z"}
+	for k, v := range want {
+		if got, err := xdb.Query(k); err != nil || got != v {
+			t.Fatalf("query %s, want: %s, got: %s, %v", k, v, got, err)
+		}
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 重启后通过扫描段文件重建索引，操作数链仍然有效
+	os.Remove(filepath.Join(dir, "INDEX"))
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	xdb.Merge("list:l", "w")
+	want["list:l"] = "x, y, z, w"
+	for k, v := range want {
+		if got, err := xdb.Query(k); err != nil || got != v {
+			t.Fatalf("query %s after reopen, want: %s, got: %s, %v", k, v, got, err)
+		}
+	}
+	// 段合并无法合并操作数链时原样复制，合并操作符恢复后仍可读取
+	xdb.Put("fold:k", "a")
+	xdb.Merge("fold:k", "b")
+	xdb.Merge("fold:k", "c")
+	segFs, _ := filepath.Glob(filepath.Join(dir, "seg_*"))
+	chainF := segFs[len(segFs)-1]
+	fail.Store(true)
+	// 写入足够的数据触发段合并，然后等待操作数链所在的段文件被合并
+	for i := 0; i < 6000; i++ {
+		xdb.Put("churn", strings.Repeat(fmt.Sprint(i%10), 1000))
+	}
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(chainF); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(chainF); !os.IsNotExist(err) {
+		t.Fatalf("want segment file: %s merged, got: %v", chainF, err)
+	}
+	fail.Store(false)
+	if got, err := xdb.Query("fold:k"); err != nil || got != "a,b,c" {
+		t.Fatalf("query fold:k after segment merge, want: a,b,c, got: %s, %v", got, err)
+	}
+	// 扫描段文件重建索引时跳过复制的操作数链中的记录
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	hintFs, _ := filepath.Glob(filepath.Join(dir, "hint_*"))
+	for _, f := range append(hintFs, filepath.Join(dir, "INDEX"), filepath.Join(dir, "MANIFEST")) {
+		os.Remove(f)
+	}
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if got, err := xdb.Query("fold:k"); err != nil || got != "a,b,c" {
+		t.Fatalf("query fold:k after reopen, want: a,b,c, got: %s, %v", got, err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	opts := xdb.Options{DataDir: dir, Retention: xdb.Retention{Versions: 3}}
+	if err := xdb.OpenWithOptions(opts); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	times := make([]time.Time, 0)
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		xdb.Put("k", v)
+		times = append(times, time.Now())
+	}
+	xdb.Remove("k")
+	check := func() {
+		history, err := xdb.History("k")
+		if err != nil || len(history) != 3 {
+			t.Fatalf("want 3 versions, got: %+v, %v", history, err)
+		}
+		if history[0].Value != "v3" || history[1].Value != "v4" || !history[2].Deleted {
+			t.Fatalf("want versions v3, v4, deleted, got: %+v", history)
+		}
+		if v, _ := xdb.GetAt("k", times[2]); v != "v3" {
+			t.Fatalf("get at v3 time, got: %s", v)
+		}
+		if v, _ := xdb.GetAt("k", times[0]); v != "" {
+			t.Fatalf("get at pruned version, want empty, got: %s", v)
+		}
+		if v, _ := xdb.GetAt("k", time.Now()); v != "" {
+			t.Fatalf("get at after delete, want empty, got: %s", v)
+		}
+	}
+	check()
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := xdb.OpenWithOptions(opts); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	check()
+}
+
+func TestBuckets(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	users, _ := xdb.Bucket("users")
+	orders, _ := xdb.Bucket("orders")
+	xdb.Put("k", "top")
+	users.Put("k", "alice")
+	users.Put("k2", "bob")
+	orders.Put("k", "o1")
+	if v, _ := users.Query("k"); v != "alice" {
+		t.Fatalf("users query k, want: alice, got: %s", v)
+	}
+	// 引擎内部使用的key不能通过顶层接口写入
+	if err := xdb.Put("\x00users\x00k", "mallory"); err == nil {
+		t.Fatalf("put internal key, want error")
+	}
+	if err := xdb.Remove("\x00users\x00k"); err == nil {
+		t.Fatalf("remove internal key, want error")
+	}
+	if prefix, err := xdb.ReservedPrefix("app"); err != nil || xdb.Put(prefix+"k", "v") != nil {
+		t.Fatalf("put reserved prefix key: %q, %v", prefix, err)
+	}
+	if keys := users.ListKey(); len(keys) != 2 || keys[0] != "k" || keys[1] != "k2" {
+		t.Fatalf("users keys, want [k k2], got: %v", keys)
+	}
+	if keys := xdb.ListKey(""); len(keys) != 1 || keys[0] != "k" {
+		t.Fatalf("top level keys, want [k], got: %v", keys)
+	}
+	if stats := users.Stats(); stats.Keys != 2 || stats.Bytes != int64(len("alice")+len("bob")) {
+		t.Fatalf("users stats, got: %+v", stats)
+	}
+	if err := xdb.DropBucket("users"); err != nil {
+		t.Fatalf("drop bucket: %v", err)
+	}
+	users.Put("k3", "carol")
+	check := func() {
+		if keys := users.ListKey(); len(keys) != 1 || keys[0] != "k3" {
+			t.Fatalf("users keys after drop, want [k3], got: %v", keys)
+		}
+		for _, kv := range [][3]string{{"orders", "k", "o1"}, {"", "k", "top"}} {
+			v, _ := xdb.Query(kv[1])
+			if kv[0] != "" {
+				v, _ = orders.Query(kv[1])
+			}
+			if v != kv[2] {
+				t.Fatalf("query %s/%s, want: %s, got: %s", kv[0], kv[1], kv[2], v)
+			}
+		}
+	}
+	check()
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 重启后通过扫描段文件重建索引，删除桶记录仍然生效
+	os.Remove(filepath.Join(dir, "INDEX"))
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	check()
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	docs, _ := xdb.Bucket("docs")
+	docs.Put("a", `{"city":"sf"}`)
+	// 二级索引只对配置了该索引的引擎有效
+	if _, err := xdb.LookupIndex("city", []byte("sf")); err == nil {
+		t.Fatalf("lookup unregistered index, want error")
+	}
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 配置索引后启动，为已有的数据构建索引
+	opts := xdb.Options{DataDir: dir, Indexes: []xdb.Index{{Bucket: "docs", Name: "city", Fn: func(key, value []byte) [][]byte {
+		var doc struct{ City string }
+		if json.Unmarshal(value, &doc) != nil || doc.City == "" {
+			return nil
+		}
+		return [][]byte{[]byte(doc.City)}
+	}}}}
+	if err := xdb.OpenWithOptions(opts); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	lookup := func(term string, want ...string) {
+		keys, err := xdb.LookupIndex("city", []byte(term))
+		if err != nil || strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Fatalf("lookup %s, want: %v, got: %v, %v", term, want, keys, err)
+		}
+	}
+	lookup("sf", "a")
+	docs.Put("b", `{"city":"sf"}`)
+	docs.Put("a", `{"city":"ny"}`)
+	lookup("sf", "b")
+	lookup("ny", "a")
+	docs.Remove("b")
+	lookup("sf")
+	if err := xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	os.Remove(filepath.Join(dir, "INDEX"))
+	if err := xdb.OpenWithOptions(opts); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	lookup("ny", "a")
+	xdb.DropBucket("docs")
+	lookup("ny")
+}
+
+func TestWatch(t *testing.T) {
+	if err := xdb.Open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	events := xdb.Watch(ctx, "w:")
+	xdb.Put("w:a", "1")
+	xdb.Put("x", "1")
+	xdb.Remove("w:a")
+	put, del := <-events, <-events
+	if put.Type != xdb.EventPut || put.Key != "w:a" || put.Value != "1" || del.Type != xdb.EventDelete || del.Seq <= put.Seq {
+		t.Fatalf("want put and delete events of w:a, got: %+v, %+v", put, del)
+	}
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatalf("want channel closed after cancel")
+	}
+	// 订阅者不读取事件，缓冲区将满时收到EventOverflow事件，订阅被关闭
+	slow := xdb.Watch(context.Background(), "")
+	for i := 0; i < xdb.WatchBufferSize+10; i++ {
+		xdb.Put("k", fmt.Sprint(i))
+	}
+	var last xdb.Event
+	n := 0
+	for event := range slow {
+		last = event
+		n++
+	}
+	if n != xdb.WatchBufferSize || last.Type != xdb.EventOverflow {
+		t.Fatalf("want %d events ending with overflow, got: %d, %+v", xdb.WatchBufferSize, n, last)
+	}
+}
+
+// readerFunc 将函数适配为io.Reader
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestChangesSince(t *testing.T) {
+	dir := t.TempDir()
+	if err := xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	xdb.Put("a", "1")
+	consumer, err := xdb.OpenConsumer("analytics")
+	if err != nil {
+		t.Fatalf("open consumer: %v", err)
+	}
+	xdb.Put("b", "2")
+	xdb.Remove("a")
+	changes := func(want string) uint64 {
+		it, err := consumer.Changes()
+		if err != nil {
+			t.Fatalf("changes: %v", err)
+		}
+		defer it.Close()
+		got := make([]string, 0)
+		var last uint64
+		for it.Next() {
+			c := it.Change()
+			if c.Bucket != "" {
+				c.Key = c.Bucket + "/" + c.Key
+			}
+			got = append(got, fmt.Sprintf("%d:%s=%s", c.Type, c.Key, c.Value))
+			last = c.Seq
+		}
+		if it.Err() != nil || strings.Join(got, ",") != want {
+			t.Fatalf("changes, want: %s, got: %v, %v", want, got, it.Err())
+		}
+		return last
+	}
+	if err = consumer.Ack(changes(fmt.Sprintf("%d:b=2,%d:a=", xdb.EventPut, xdb.EventDelete))); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if err = xdb.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// 重启后从已确认的序列号之后继续读取
+	if err = xdb.Open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	if consumer, err = xdb.OpenConsumer("analytics"); err != nil {
+		t.Fatalf("open consumer: %v", err)
+	}
+	// 变化中包含桶中的key、删除桶以及保存在blob文件中的value，value可以包含空白字符
+	xdb.Put("c", "3")
+	doc := "{\"a\": 1}\n"
+	xdb.Put("doc", doc)
+	users, _ := xdb.Bucket("users")
+	users.Put("u", "1")
+	xdb.DropBucket("users")
+	big := strings.Repeat("b", 4096)
+	xdb.Put("big", big)
+	changes(fmt.Sprintf("%d:c=3,%d:doc=%s,%d:users/u=1,%d:users/=,%d:big=%s", xdb.EventPut, xdb.EventPut, doc, xdb.EventPut, xdb.EventDropBucket, xdb.EventPut, big))
+	// 段合并不合并包含未确认变化的段文件
+	for i := 0; i < 5000; i++ {
+		xdb.Put("churn", strings.Repeat(fmt.Sprint(i%10), 1000))
+	}
+	if err = xdb.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	it, err := consumer.Changes()
+	if err != nil {
+		t.Fatalf("changes: %v", err)
+	}
+	var n int
+	var last uint64
+	for it.Next() {
+		n, last = n+1, it.Change().Seq
+	}
+	it.Close()
+	if n != 5005 {
+		t.Fatalf("unacked changes after segment merge, want: 5005, got: %d, %v", n, it.Err())
+	}
+	// 全部确认之后段合并丢弃被覆盖的记录
+	consumer.Ack(last)
+	if err = xdb.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if it, err = xdb.ChangesSince(0); !errors.Is(err, xdb.ErrChangesCompacted) {
+		t.Fatalf("changes since 0 after segment merge, want ErrChangesCompacted, got: %v", err)
+	}
+	// 段合并复制包含空白字符的value
+	if v, err := xdb.Query("doc"); err != nil || v != doc {
+		t.Fatalf("query doc after segment merge, want: %q, got: %q, %v", doc, v, err)
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	if err := xdb.Open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer xdb.Close()
+	ts := httptest.NewServer(server.NewHTTPServer("").Handler())
+	defer ts.Close()
+	do := func(method, path, body string, wantStatus int) string {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("%s %s, want status: %d, got: %d, %s", method, path, wantStatus, resp.StatusCode, data)
+		}
+		return strings.TrimSpace(string(data))
+	}
+	for _, k := range []string{"a1", "a2", "a3", "b1"} {
+		do(http.MethodPut, "/kv/"+k, "v"+k, http.StatusNoContent)
+	}
+	if got := do(http.MethodGet, "/kv/a1", "", http.StatusOK); got != `{"key":"a1","value":"va1"}` {
+		t.Fatalf("get a1, got: %s", got)
+	}
+	if got := do(http.MethodGet, "/kv?prefix=a&limit=2", "", http.StatusOK); got != `{"keys":["a1","a2"],"next":"a2"}` {
+		t.Fatalf("list first page, got: %s", got)
+	}
+	if got := do(http.MethodGet, "/kv?prefix=a&limit=2&after=a2", "", http.StatusOK); got != `{"keys":["a3"],"next":""}` {
+		t.Fatalf("list last page, got: %s", got)
+	}
+	do(http.MethodPost, "/batch", `{"ops":[{"op":"put","key":"c1","value":"vc1"},{"op":"delete","key":"a1"}]}`, http.StatusNoContent)
+	if got := do(http.MethodPost, "/batch/get", `{"keys":["a1","c1"]}`, http.StatusOK); got != `{"values":{"c1":"vc1"}}` {
+		t.Fatalf("batch get, got: %s", got)
+	}
+	// value 可以包含空白字符；非法的key不写入，返回JSON格式的错误
+	do(http.MethodPut, "/kv/d1", "has space\n", http.StatusNoContent)
+	if got := do(http.MethodGet, "/kv/d1", "", http.StatusOK); got != `{"key":"d1","value":"has space\n"}` {
+		t.Fatalf("get d1, got: %s", got)
+	}
+	do(http.MethodPut, "/kv/d2", "", http.StatusNoContent)
+	if got := do(http.MethodGet, "/kv/d2", "", http.StatusOK); got != `{"key":"d2","value":""}` {
+		t.Fatalf("get d2, got: %s", got)
+	}
+	if got := do(http.MethodPut, "/kv/d%202", "v", http.StatusBadRequest); !strings.HasPrefix(got, `{"error":`) {
+		t.Fatalf("put bad key, got: %s", got)
+	}
+	do(http.MethodDelete, "/kv/b1", "", http.StatusNoContent)
+	do(http.MethodGet, "/kv/b1", "", http.StatusNotFound)
+	do(http.MethodGet, "/put?key=e1&value=ve1", "", http.StatusNoContent)
+	if got := do(http.MethodGet, "/get?key=e1", "", http.StatusOK); got != "ve1" {
+		t.Fatalf("legacy get, got: %s", got)
+	}
+}
+
+func TestRESPServer(t *testing.T) {
+	if err := xdb.Open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := server.NewRESPServer("")
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// 读取一个响应，数组按行拼接
+	var readReply func() string
+	readReply = func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		switch line[0] {
+		case '$':
+			if line == "$-1" {
+				return "nil"
+			}
+			bulk, _ := reader.ReadString('\n')
+			return strings.TrimSuffix(bulk, "\r\n")
+		case '*':
+			n, _ := strconv.Atoi(line[1:])
+			items := make([]string, 0, n)
+			for i := 0; i < n; i++ {
+				items = append(items, readReply())
+			}
+			return "[" + strings.Join(items, " ") + "]"
+		}
+		return line
+	}
+	do := func(want string, args ...string) {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		conn.Write(buf.Bytes())
+		if got := readReply(); got != want {
+			t.Fatalf("%v, want: %s, got: %s", args, want, got)
+		}
+	}
+	do("+PONG", "PING")
+	do("+OK", "SET", "a", "1")
+	do("nil", "SET", "a", "2", "NX")
+	do("nil", "SET", "b", "2", "XX")
+	do(":2", "INCR", "a")
+	do("+OK", "SET", "w", "a b")
+	do("a b", "GET", "w")
+	do("+OK", "SET", "e", "")
+	do("", "GET", "e")
+	// 通过引擎直接写入的key可以通过网络服务读取，反之亦然
+	xdb.Put("x", "from engine")
+	do("from engine", "GET", "x")
+	if v, _ := xdb.Query("w"); v != "a b" {
+		t.Fatalf("query w, want: a b, got: %q", v)
+	}
+	do("+OK", "MSET", "k1", "v1", "k2", "v2")
+	do("[2 v1 nil]", "MGET", "a", "k1", "zz")
+	do(":2", "EXISTS", "a", "zz", "a")
+	do("[k1 k2]", "KEYS", "k?")
+	do("+OK", "SET", "t", "1", "PX", "50")
+	do("1", "GET", "t")
+	time.Sleep(100 * time.Millisecond)
+	do("nil", "GET", "t")
+	do(":2", "DEL", "a", "k1", "t")
+	// SCAN 分多次遍历全部key，遍历期间一直存在的key都被返回
+	for i := 0; i < 20; i++ {
+		do("+OK", "SET", fmt.Sprintf("s%02d", i), "1")
+	}
+	seen := make(map[string]bool)
+	for cursor := "0"; ; {
+		fmt.Fprintf(conn, "*6\r\n$4\r\nSCAN\r\n$%d\r\n%s\r\n$5\r\nMATCH\r\n$2\r\ns*\r\n$5\r\nCOUNT\r\n$1\r\n3\r\n", len(cursor), cursor)
+		reply := strings.Trim(readReply(), "[]")
+		fields := strings.Fields(reply)
+		cursor = fields[0]
+		for _, key := range fields[1:] {
+			seen[key] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 20 {
+		t.Fatalf("scan, want 20 keys, got: %d", len(seen))
+	}
+	// 关闭时空闲连接被关闭，Serve返回ErrServerClosed
+	if err = server.Shutdown(context.Background(), srv); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err = <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("serve, want ErrServerClosed, got: %v", err)
+	}
+}
+
+func TestMemcacheServer(t *testing.T) {
+	if err := xdb.Open(t.TempDir()); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := server.NewMemcacheServer("")
+	go srv.Serve(ln)
+	defer server.Shutdown(context.Background(), srv)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// 发送请求并读取lines行响应
+	do := func(req string, lines int) []string {
+		io.WriteString(conn, req)
+		reply := make([]string, 0, lines)
+		for i := 0; i < lines; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%q, read reply: %v", req, err)
+			}
+			reply = append(reply, strings.TrimSuffix(line, "\r\n"))
+		}
+		return reply
+	}
+	expect := func(req string, want ...string) {
+		if got := do(req, len(want)); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Fatalf("%q, want: %v, got: %v", req, want, got)
+		}
+	}
+	expect("set a 5 0 2\r\nhi\r\n", "STORED")
+	expect("add a 0 0 1\r\nx\r\n", "NOT_STORED")
+	expect("replace b 0 0 1\r\nx\r\n", "NOT_STORED")
+	expect("get a b\r\n", "VALUE a 5 2", "hi", "END")
+	expect("set e 0 0 0\r\n\r\nset s 0 0 3\r\na b\r\n", "STORED", "STORED")
+	expect("get e s\r\n", "VALUE e 0 0", "", "VALUE s 0 3", "a b", "END")
+	// cas 使用gets返回的版本号，版本号过期时返回EXISTS
+	gets := do("gets a\r\n", 3)
+	cas := strings.Fields(gets[0])[4]
+	expect(fmt.Sprintf("cas a 7 0 3 %s\r\nbye\r\n", cas), "STORED")
+	expect(fmt.Sprintf("cas a 7 0 3 %s\r\nbye\r\n", cas), "EXISTS")
+	expect("cas zz 0 0 1 1\r\nx\r\n", "NOT_FOUND")
+	expect("get a\r\n", "VALUE a 7 3", "bye", "END")
+	expect("set n 3 0 2\r\n10\r\n", "STORED")
+	expect("incr n 5\r\n", "15")
+	expect("decr n 100\r\n", "0")
+	expect("incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	expect("get n\r\n", "VALUE n 3 1", "0", "END")
+	expect("set t 0 -1 1\r\nx\r\n", "STORED")
+	expect("get t\r\n", "END")
+	expect("set q 0 0 1 noreply\r\nq\r\ndelete q\r\n", "DELETED")
+	expect("delete q\r\n", "NOT_FOUND")
+	expect("bogus\r\n", "ERROR")
+}
@@ -0,0 +1,158 @@
+package xdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Txn 乐观事务：事务内的写入先缓存在内存中，提交时检查事务读取过的key是否被其他写入修改，
+// 未冲突时将全部写入作为一个批量写入原子地追加到段文件，冲突时返回ErrConflict，事务内的写入全部丢弃
+// 批量写入的记录带有FlagBatch标记，之后追加一条提交记录(KindCommit)；崩溃恢复时没有提交记录的批量写入被丢弃
+// 事务对象不支持并发使用
+type Txn struct {
+	engine *DBEngine
+	reads  map[string]uint64  // 事务读取过的key及读取时的序列号，key不存在时为0
+	writes map[string]*string // 事务内写入的key及value，value为nil表示删除
+	keys   []string           // 写入key的顺序
+	done   bool               // 事务是否已提交或回滚
+}
+
+// Begin 开始一个乐观事务
+func Begin() *Txn {
+	return &Txn{
+		engine: dbEngine,
+		reads:  make(map[string]uint64),
+		writes: make(map[string]*string),
+		keys:   make([]string, 0),
+	}
+}
+
+// Get 在事务中查找key对应的value：优先返回事务内的写入，否则从数据库中读取，并记录读取时的序列号用于提交时的冲突检测；
+// key不存在时返回空字符串
+func (txn *Txn) Get(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("%s", "idxK can not be empty")
+	}
+	if txn.done {
+		return "", ErrTxnDone
+	}
+	if err := txn.engine.checkOpen(); err != nil {
+		return "", err
+	}
+	if value, ok := txn.writes[key]; ok {
+		if value == nil {
+			return "", nil
+		}
+		return *value, nil
+	}
+	indexValue, ok := txn.engine.getMemIdx(key)
+	if _, read := txn.reads[key]; !read {
+		txn.reads[key] = indexValue.seq
+	}
+	if !ok {
+		return "", nil
+	}
+	return txn.engine.seekKey(key, indexValue)
+}
+
+// GetVersion 与Get相同，同时返回key在事务中首次读取时的序列号(key不存在或只在事务内写入过时为0)，可作为key的版本号用于比较并交换
+func (txn *Txn) GetVersion(key string) (string, uint64, error) {
+	value, err := txn.Get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, txn.reads[key], nil
+}
+
+// Put 在事务中写入(key,value)，提交后生效
+func (txn *Txn) Put(key, value string) error {
+	if key == "" || value == "" {
+		return fmt.Errorf("idxK, value can not be empty, idxK: %s, value: %s", key, value)
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	return txn.write(key, &value)
+}
+
+// Delete 在事务中删除key，提交后生效
+func (txn *Txn) Delete(key string) error {
+	if key == "" {
+		return fmt.Errorf("idxK, value can not be empty, idxK: %s", key)
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	return txn.write(key, nil)
+}
+
+// write 缓存事务内的写入
+func (txn *Txn) write(key string, value *string) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if _, ok := txn.writes[key]; !ok {
+		txn.keys = append(txn.keys, key)
+	}
+	txn.writes[key] = value
+	return nil
+}
+
+// Rollback 回滚事务，丢弃事务内的写入；重复调用无副作用
+func (txn *Txn) Rollback() {
+	txn.done = true
+}
+
+// Commit 提交事务：若事务读取过的key在读取之后被修改(包括删除)，返回ErrConflict；否则原子地写入事务内的全部写入
+// 无论提交是否成功，事务都将结束
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	if len(txn.keys) == 0 {
+		return nil
+	}
+	engine := txn.engine
+	if err := engine.checkOpen(); err != nil {
+		return err
+	}
+	// 1. 在锁外完成value的压缩、加密
+	keyID, err := engine.crypt.currentKeyID()
+	if err != nil {
+		return err
+	}
+	tm := time.Now().UnixNano()
+	segs := make([]*Segment, 0, len(txn.keys))
+	for _, key := range txn.keys {
+		seg := &Segment{
+			Hint: Hint{
+				key:   key,
+				keysz: len(key),
+				val:   val{tm: tm, keyID: keyID},
+			},
+		}
+		if value := txn.writes[key]; value != nil {
+			stored, codecID, valKeyID, err := engine.encodeVal(key, *value)
+			if err != nil {
+				return err
+			}
+			seg.value, seg.valsz, seg.codec, seg.keyID = stored, len(stored), codecID, valKeyID
+		}
+		segs = append(segs, seg)
+	}
+	// 2. 持有段文件锁，检查冲突后写入
+	engine.segFMu.Lock()
+	defer engine.segFMu.Unlock()
+	for key, seq := range txn.reads {
+		indexValue, _ := engine.getMemIdx(key)
+		if indexValue.seq != seq {
+			return fmt.Errorf("%w: idxK: %s", ErrConflict, key)
+		}
+	}
+	if err = engine.writeBatchLocked(segs); err != nil && !errors.Is(err, ErrClosed) {
+		slogger.Fatalf("write txn to file: %s error: %v", engine.segFName, err)
+	}
+	return err
+}
@@ -1,6 +1,8 @@
 package xdb
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -92,6 +94,37 @@ func sortDataF(fs []os.DirEntry, order uint) []os.DirEntry {
 	return fs
 }
 
+// sortFNames 按照文件名称中的时间戳对文件名称排序
+// order： 文件顺序 1- 倒序 0-顺序
+func sortFNames(names []string, order uint) []string {
+	sort.Slice(names, func(i, j int) bool {
+		tm, _ := parseTm(Delimiter, names[i])
+		tm1, _ := parseTm(Delimiter, names[j])
+		switch order {
+		case ASC:
+			return tm < tm1
+		case DESC:
+			return tm > tm1
+		default:
+			return false
+		}
+	})
+	return names
+}
+
+// syncDir 将目录项的变更(文件创建、rename)刷新到磁盘
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		slogger.Errorf("open dir: %s error: %v", dir, err)
+		return
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		slogger.Errorf("sync dir: %s error: %v", dir, err)
+	}
+}
+
 // crc 根据数据串生成crc校验值
 func crc(dataStr string) uint32 {
 	return crc32.ChecksumIEEE([]byte(dataStr))
@@ -140,6 +173,10 @@ func hint2MemIndex(hint *Hint, fName string) *MemIdx {
 	memIndex := &MemIdx{}
 	memIndex.idxK = hint.key
 	memIndex.idxV.tm = hint.tm
+	memIndex.idxV.seq = hint.seq
+	memIndex.idxV.kind = hint.kind
+	memIndex.idxV.codec = hint.codec
+	memIndex.idxV.keyID = hint.keyID
 	memIndex.idxV.valsz = hint.valsz
 	memIndex.idxV.valops = hint.valops
 	memIndex.idxV.fName = fName
@@ -152,6 +189,10 @@ func segment2MemIndex(seg *Segment, fName string) *MemIdx {
 	memIndex.idxK = seg.key
 	memIndex.idxV.fName = fName
 	memIndex.idxV.tm = seg.tm
+	memIndex.idxV.seq = seg.seq
+	memIndex.idxV.kind = seg.kind &^ (FlagBatch | FlagMoved)
+	memIndex.idxV.codec = seg.codec
+	memIndex.idxV.keyID = seg.keyID
 	memIndex.idxV.valsz = seg.valsz
 	memIndex.idxV.valops = seg.valops
 	return memIndex
@@ -165,6 +206,10 @@ func seg2Hint(seg *Segment) *Hint {
 	hint.valsz = seg.valsz
 	hint.valops = seg.valops
 	hint.tm = seg.tm
+	hint.seq = seg.seq
+	hint.kind = seg.kind &^ (FlagBatch | FlagMoved)
+	hint.codec = seg.codec
+	hint.keyID = seg.keyID
 	return hint
 }
 
@@ -172,6 +217,10 @@ func seg2Hint(seg *Segment) *Hint {
 func hint2Seg(hint *Hint) *Segment {
 	seg := &Segment{}
 	seg.tm = hint.tm
+	seg.seq = hint.seq
+	seg.kind = hint.kind
+	seg.codec = hint.codec
+	seg.keyID = hint.keyID
 	seg.keysz = hint.keysz
 	seg.valsz = hint.valsz
 	seg.valops = hint.valops
@@ -179,63 +228,160 @@ func hint2Seg(hint *Hint) *Segment {
 	return seg
 }
 
-// encodeHint 将数据按格式进行编码
-func encodeHint(hint *Hint) string {
-	return fmt.Sprintf(HintFormat, hint.tm, hint.keysz, hint.valsz, hint.valops, hint.key)
+// encodeHint 将数据按格式进行编码，头部增加CRC校验值；若记录已加密(keyID不为0)，使用c加密key
+func encodeHint(hint *Hint, c *cryptor) (string, error) {
+	storedKey, err := c.sealKey(hint.keyID, hint.key)
+	if err != nil {
+		return "", err
+	}
+	dataStr := fmt.Sprintf(HintFormat, hint.seq, hint.tm, hint.kind, hint.codec, hint.keyID, len(storedKey), hint.valsz, hint.valops, storedKey)
+	return fmt.Sprintf(CRCFormat, crc(dataStr), dataStr), nil
 }
 
-// decodeHint
-func decodeHint(dataStr string) (*Hint, error) {
+// decodeHint 从hint文件中解析数据，并校验CRC；若记录已加密，使用c解密key
+func decodeHint(data string, c *cryptor) (*Hint, error) {
 	hint := &Hint{}
-	_, err := fmt.Sscanf(dataStr, HintFormat, &hint.tm, &hint.keysz, &hint.valsz, &hint.valops, &hint.key)
+	var checkSum uint32
+	if len(data) < HintRecHeaderSize+NewLineSize || data[len(data)-1] != DataDelimiterByte {
+		return nil, fmt.Errorf("decodeHint data: %q broken", data)
+	}
+	dataStr := data[8 : len(data)-NewLineSize]
+	if _, err := fmt.Sscanf(data[:8], "%08x", &checkSum); err != nil {
+		return nil, fmt.Errorf("decodeHint data: %s error: %v", data, err)
+	}
+	if !checkCRC(dataStr, checkSum) {
+		return nil, fmt.Errorf("crc broken,data: %s,crc: %d", dataStr, checkSum)
+	}
+	// key 按keysz截取，可以包含空白字符
+	_, err := fmt.Sscanf(data[8:HintRecHeaderSize], strings.TrimSuffix(HintFormat, "%s"), &hint.seq, &hint.tm, &hint.kind, &hint.codec, &hint.keyID, &hint.keysz, &hint.valsz, &hint.valops)
 	if err != nil {
-		return nil, fmt.Errorf("decodeHint seg2Hint: %s error: %v\n", dataStr, err)
+		return nil, fmt.Errorf("decodeHint seg2Hint: %s error: %v", dataStr, err)
 	}
+	if hint.keysz != len(dataStr)-(HintRecHeaderSize-8) {
+		return nil, fmt.Errorf("decodeHint seg2Hint: %s bad keysz: %d", dataStr, hint.keysz)
+	}
+	hint.key = data[HintRecHeaderSize : len(data)-NewLineSize]
+	if hint.key, err = c.openKey(hint.keyID, hint.key); err != nil {
+		return nil, err
+	}
+	hint.keysz = len(hint.key)
 	return hint, nil
 }
 
-// encodeSeg 将数据按格式进行编码
-func encodeSeg(seg *Segment) string {
-	dataStr := fmt.Sprintf(SegFormat, seg.tm, seg.keysz, seg.valsz, seg.key, seg.value)
+// encodeSeg 将数据按格式进行编码；若记录已加密(keyID不为0)，使用c加密key，value在写入前已经加密
+func encodeSeg(seg *Segment, c *cryptor) (string, error) {
+	storedKey, err := c.sealKey(seg.keyID, seg.key)
+	if err != nil {
+		return "", err
+	}
+	return encodeSegRaw(seg, storedKey)
+}
+
+// encodeSegRaw 使用已经加密的key(storedKey)将数据按格式进行编码
+func encodeSegRaw(seg *Segment, storedKey string) (string, error) {
+	if len(storedKey) > MaxKeySize {
+		return "", fmt.Errorf("stored key size: %d exceeds limit: %d", len(storedKey), MaxKeySize)
+	}
+	if len(seg.value) > MaxValSize {
+		return "", fmt.Errorf("stored value size: %d exceeds limit: %d", len(seg.value), MaxValSize)
+	}
+	dataStr := fmt.Sprintf(SegFormat, seg.seq, seg.tm, seg.kind, seg.codec, seg.keyID, len(storedKey), len(seg.value), storedKey, seg.value)
 	checkSum := crc(dataStr)
-	return fmt.Sprintf(CRCFormat, checkSum, dataStr)
+	return fmt.Sprintf(CRCFormat, checkSum, dataStr), nil
+}
+
+// readSeg 从段文件中读取一条记录：先读取长度固定的头部，再按keysz、valsz读取key、value和换行符，key、value中可以包含任意字符；
+// 文件末尾的残缺记录返回io.EOF；头部无法解析或记录不以换行符结尾时读取到下一个换行符，由decodeSeg校验失败后跳过
+func readSeg(reader *bufio.Reader) (string, error) {
+	header := make([]byte, SegRecHeaderSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		return string(header[:n]), io.EOF
+	}
+	var keysz, valsz int
+	if _, err := fmt.Sscanf(string(header[SegRecHeaderSize-5:]), "%02x%03x", &keysz, &valsz); err != nil {
+		return readLine(reader, string(header))
+	}
+	body := make([]byte, keysz+valsz+NewLineSize)
+	if n, err := io.ReadFull(reader, body); err != nil {
+		return string(header) + string(body[:n]), io.EOF
+	}
+	if body[len(body)-1] != DataDelimiterByte {
+		return readLine(reader, string(header)+string(body))
+	}
+	return string(header) + string(body), nil
+}
+
+// readLine 读取到下一个换行符，返回读取的内容(以prefix开头)
+func readLine(reader *bufio.Reader, prefix string) (string, error) {
+	if strings.HasSuffix(prefix, string(DataDelimiterByte)) {
+		return prefix, nil
+	}
+	line, err := reader.ReadString(DataDelimiterByte)
+	if errors.Is(err, io.EOF) {
+		return prefix + line, io.EOF
+	}
+	return prefix + line, err
 }
 
-// decodeSeg 从数据文件中解析数据
-func decodeSeg(data string) (*Segment, error) {
+// decodeSeg 从数据文件中解析数据：按keysz、valsz截取key和value；若记录已加密，使用c解密key，value保持存储格式
+func decodeSeg(data string, c *cryptor) (*Segment, error) {
 	seg := &Segment{}
-	var segKV, keyAndValue string
-	_, err := fmt.Sscanf(data, CRCFormat, &seg.crcVal, &segKV)
+	if len(data) < SegRecHeaderSize+NewLineSize {
+		return nil, fmt.Errorf("segment record: %q too short", data)
+	}
+	_, err := fmt.Sscanf(data[:SegRecHeaderSize], SegRecHeaderFormat, &seg.crcVal, &seg.seq, &seg.tm, &seg.kind, &seg.codec, &seg.keyID, &seg.keysz, &seg.valsz)
 	if err != nil {
-		return nil, fmt.Errorf("decodeHint data: %s error: %v", data, err)
+		return nil, fmt.Errorf("segment record: %q error: %v", data, err)
 	}
-	if !checkCRC(segKV, seg.crcVal) {
-		return nil, fmt.Errorf("crc broken,data: %s,crc: %d", segKV, seg.crcVal)
+	if len(data) != SegRecHeaderSize+seg.keysz+seg.valsz+NewLineSize || data[len(data)-1] != DataDelimiterByte {
+		return nil, fmt.Errorf("segment record: %q bad keysz: %d or valsz: %d", data, seg.keysz, seg.valsz)
 	}
-	_, err = fmt.Sscanf(segKV, SegFormatKV, &seg.tm, &seg.keysz, &seg.valsz, &keyAndValue)
-	if err != nil {
-		return nil, fmt.Errorf("segKV: %s error: %v", segKV, err)
+	if !checkCRC(data[8:len(data)-NewLineSize], seg.crcVal) {
+		return nil, fmt.Errorf("crc broken,data: %s,crc: %d", data, seg.crcVal)
 	}
-	seg.key = keyAndValue[:seg.keysz]
+	keyAndValue := data[SegRecHeaderSize : len(data)-NewLineSize]
 	seg.value = keyAndValue[seg.keysz:]
+	if seg.key, err = c.openKey(seg.keyID, keyAndValue[:seg.keysz]); err != nil {
+		return nil, err
+	}
+	seg.keysz = len(seg.key)
 	return seg, nil
 }
 
-// seekKey 从段文件中读取key对应的value
-func seekKey(dataDir string, index MemIdxV) (string, error) {
-	f, err := os.OpenFile(path.Join(dataDir, index.fName), os.O_RDONLY, FileMode)
+// seekKey 从段文件(或blob文件)中读取key对应的value，若value经过加密、压缩则解密、解压
+func (engine *DBEngine) seekKey(key string, index MemIdxV) (string, error) {
+	// KindMerge 记录中保存的是操作数，需要与之前的记录合并
+	if index.kind == KindMerge {
+		return engine.seekMerge(key, index)
+	}
+	buf, err := engine.readRec(index)
+	if err != nil {
+		return "", err
+	}
+	// KindBlob 记录中保存的是blob指针，从blob文件中读取value
+	if index.kind == KindBlob {
+		if buf, err = engine.seekBlob(string(buf)); err != nil {
+			return "", err
+		}
+	}
+	return engine.decodeVal(key, buf, index.codec, index.keyID)
+}
+
+// readRec 读取索引项指向的记录在段文件中保存的value(未解码)
+func (engine *DBEngine) readRec(index MemIdxV) ([]byte, error) {
+	f, err := os.OpenFile(path.Join(engine.dataDir, index.fName), os.O_RDONLY, FileMode)
 	defer f.Close()
 	if err != nil {
-		return "", fmt.Errorf("open file: %s error: %v", index.fName, err)
+		return nil, fmt.Errorf("open file: %s error: %v", index.fName, err)
 	}
 	_, err = f.Seek(index.valops, 0)
 	if err != nil {
-		return "", fmt.Errorf("seek offset error: %v", err)
+		return nil, fmt.Errorf("seek offset error: %v", err)
 	}
 	buf := make([]byte, index.valsz)
 	_, err = io.ReadFull(f, buf)
 	if err != nil {
-		return "", fmt.Errorf("read file error: %v", err)
+		return nil, fmt.Errorf("read file error: %v", err)
 	}
-	return string(buf), nil
+	return buf, nil
 }
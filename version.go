@@ -0,0 +1,204 @@
+package xdb
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// 历史版本：启用保留策略(Options.Retention)后，引擎在内存中为每个key维护保留范围内的全部版本(包括删除记录)，按序列号升序排列；
+// 引擎启动时扫描全部hint文件/段文件加载历史版本，段合并时保留范围内的旧版本随当前版本一起复制到合并生成的段文件，
+// 仍被历史版本引用的blob文件不进行垃圾回收
+
+// Retention 历史版本保留策略，保留满足任一条件的版本；均为0时只保留当前版本
+type Retention struct {
+	Versions int           // 每个key保留最近的版本数
+	Age      time.Duration // 保留写入时间在Age之内的版本
+}
+
+// enabled 是否保留历史版本
+func (r Retention) enabled() bool {
+	return r.Versions > 0 || r.Age > 0
+}
+
+// prune 按保留策略过滤版本列表；当前版本(最后一个版本且不是删除记录)始终保留
+func (r Retention) prune(vers []MemIdxV, now int64) []MemIdxV {
+	kept := make([]MemIdxV, 0, len(vers))
+	for i, v := range vers {
+		if (i == len(vers)-1 && v.valsz > 0) ||
+			(r.Versions > 0 && i >= len(vers)-r.Versions) ||
+			(r.Age > 0 && v.tm >= now-int64(r.Age)) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// Version key的一个历史版本
+type Version struct {
+	Seq     uint64    // 序列号
+	Time    time.Time // 写入时间
+	Value   string    // value，删除记录为空字符串
+	Deleted bool      // 是否为删除记录
+}
+
+// GetAt 查找key在t时刻的value：返回写入时间不晚于t的最新版本；该版本为删除记录、超出保留范围或不存在时返回空字符串
+func GetAt(key string, t time.Time) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("%s", "idxK can not be empty")
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return "", err
+	}
+	var (
+		at    MemIdxV
+		found bool
+	)
+	for _, v := range dbEngine.versionsOf(key) {
+		if v.tm <= t.UnixNano() {
+			at, found = v, true
+		}
+	}
+	if !found || at.valsz == 0 {
+		return "", nil
+	}
+	return dbEngine.seekKey(key, at)
+}
+
+// History 按序列号升序返回key保留范围内的全部版本
+func History(key string) ([]Version, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%s", "idxK can not be empty")
+	}
+	if err := dbEngine.checkOpen(); err != nil {
+		return nil, err
+	}
+	vers := dbEngine.versionsOf(key)
+	history := make([]Version, 0, len(vers))
+	for _, v := range vers {
+		ver := Version{Seq: v.seq, Time: time.Unix(0, v.tm), Deleted: v.valsz == 0}
+		if !ver.Deleted {
+			value, err := dbEngine.seekKey(key, v)
+			if err != nil {
+				return nil, fmt.Errorf("idxK: %s, seq: %d, read value error: %v", key, v.seq, err)
+			}
+			ver.Value = value
+		}
+		history = append(history, ver)
+	}
+	return history, nil
+}
+
+// versionsOf 获取key的版本列表副本；未启用保留策略时只返回当前版本
+func (engine *DBEngine) versionsOf(key string) []MemIdxV {
+	engine.memIdxMu.RLock()
+	defer engine.memIdxMu.RUnlock()
+	if engine.versions == nil {
+		if idxV, ok := engine.memIdx[key]; ok {
+			return []MemIdxV{idxV}
+		}
+		return nil
+	}
+	return append([]MemIdxV(nil), engine.versions[key]...)
+}
+
+// getVersion 获取key序列号为seq的版本
+func (engine *DBEngine) getVersion(key string, seq uint64) (MemIdxV, bool) {
+	engine.memIdxMu.RLock()
+	defer engine.memIdxMu.RUnlock()
+	for _, v := range engine.versions[key] {
+		if v.seq == seq {
+			return v, true
+		}
+	}
+	return MemIdxV{}, false
+}
+
+// putVersion 将索引项加入key的版本列表，已存在相同序列号的版本时更新其位置(段合并、blob文件垃圾回收)；调用方需持有memIdxMu
+func (engine *DBEngine) putVersion(memIdx *MemIdx) {
+	if engine.versions == nil {
+		return
+	}
+	idxV := memIdx.idxV
+	vers := make([]MemIdxV, 0, len(engine.versions[memIdx.idxK])+1)
+	for _, v := range engine.versions[memIdx.idxK] {
+		if v.seq != idxV.seq {
+			vers = append(vers, v)
+		}
+	}
+	i := sort.Search(len(vers), func(i int) bool { return vers[i].seq > idxV.seq })
+	vers = append(vers, MemIdxV{})
+	copy(vers[i+1:], vers[i:])
+	vers[i] = idxV
+	engine.setVersions(memIdx.idxK, engine.retention.prune(vers, time.Now().UnixNano()))
+}
+
+// relocVersion 段合并时更新旧版本的位置，不影响内存索引
+func (engine *DBEngine) relocVersion(memIdx *MemIdx) {
+	engine.memIdxMu.Lock()
+	defer engine.memIdxMu.Unlock()
+	engine.putVersion(memIdx)
+}
+
+// pruneVersions 按保留策略清理全部key的版本列表
+func (engine *DBEngine) pruneVersions() {
+	engine.memIdxMu.Lock()
+	defer engine.memIdxMu.Unlock()
+	now := time.Now().UnixNano()
+	for key, vers := range engine.versions {
+		engine.setVersions(key, engine.retention.prune(vers, now))
+	}
+}
+
+// setVersions 设置key的版本列表，列表为空时删除key；调用方需持有memIdxMu
+func (engine *DBEngine) setVersions(key string, vers []MemIdxV) {
+	if len(vers) == 0 {
+		delete(engine.versions, key)
+		return
+	}
+	engine.versions[key] = vers
+}
+
+// isRetainedBlob 判断blob文件blobFName中的记录是否仍被历史版本引用
+func (engine *DBEngine) isRetainedBlob(blobFName string, seg *Segment) bool {
+	for _, v := range engine.versionsOf(seg.key) {
+		if engine.refsBlob(v, blobFName, seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadVersions 扫描全部段文件(存在hint文件时扫描hint文件)，加载保留范围内的历史版本
+func (engine *DBEngine) loadVersions(segFs []string) error {
+	engine.versions = make(map[string][]MemIdxV)
+	put := func(memIdx *MemIdx) {
+		engine.memIdxMu.Lock()
+		defer engine.memIdxMu.Unlock()
+		engine.putVersion(memIdx)
+	}
+	// 按创建时间升序扫描，序列号相同的记录(blob文件垃圾回收迁移的记录)以较新的段文件中的记录为准
+	for i := len(segFs) - 1; i >= 0; i-- {
+		segFName := segFs[i]
+		if engine.isExistCompF(segFName, SegFNamePrefix) {
+			hintFName, _ := compFName(segFName, SegFNamePrefix)
+			if err := engine.scanHintF(path.Join(engine.dataDir, hintFName), put); err == nil {
+				continue
+			}
+		}
+		f, reader, err := openDataF(path.Join(engine.dataDir, segFName), SegFMagic)
+		if err != nil {
+			return err
+		}
+		_, err = engine.scanSegF(reader, FHeaderSize, func(seg *Segment) error {
+			put(segment2MemIndex(seg, segFName))
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("scan segment file: %s error: %v", segFName, err)
+		}
+	}
+	return nil
+}
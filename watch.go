@@ -0,0 +1,145 @@
+package xdb
+
+import (
+	"context"
+	"strings"
+)
+
+// 订阅：每次写入成功(记录写入段文件并更新索引)后，向key匹配前缀的订阅者发送事件；事件在持有段文件锁时按序列号顺序发送，
+// 发送不会阻塞写入：订阅者的缓冲区(WatchBufferSize)将满时，发送一个EventOverflow事件并关闭该订阅，订阅者需要重新订阅并自行补齐期间的变化
+
+// EventType 事件类型
+type EventType uint8
+
+const (
+	EventPut        EventType = iota + 1 // 写入
+	EventDelete                          // 删除
+	EventOverflow                        // 订阅者处理过慢，订阅已关闭
+	EventDropBucket                      // 删除桶(只出现在CDC变化中)
+)
+
+// Event key的变化事件
+type Event struct {
+	Type   EventType // 事件类型
+	Bucket string    // 桶名称，顶层key为空(只在CDC变化中设置)
+	Key    string    // key；CDC变化中为桶中的key，删除桶时为空
+	Value  string    // 写入的value
+	Seq    uint64    // 写入记录的序列号
+}
+
+// watcher 订阅者
+type watcher struct {
+	prefix string        // 订阅的key前缀
+	ch     chan Event    // 事件缓冲区
+	done   chan struct{} // 订阅关闭时关闭
+}
+
+// Watch 订阅以prefix开头的key的变化，ctx取消或引擎关闭时关闭返回的channel；数据库未打开或已关闭时返回已关闭的channel
+func Watch(ctx context.Context, prefix string) <-chan Event {
+	engine := dbEngine
+	w := &watcher{prefix: prefix, ch: make(chan Event, WatchBufferSize), done: make(chan struct{})}
+	if engine == nil {
+		close(w.ch)
+		return w.ch
+	}
+	engine.watchMu.Lock()
+	// Close 设置关闭标记之后关闭全部订阅，在watchMu中检查关闭标记，保证订阅不会遗漏
+	if engine.closed.Load() {
+		engine.watchMu.Unlock()
+		close(w.ch)
+		return w.ch
+	}
+	engine.watchGen++
+	id := engine.watchGen
+	engine.watchers[id] = w
+	engine.watchMu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			engine.unwatch(id)
+		case <-w.done:
+		}
+	}()
+	return w.ch
+}
+
+// unwatch 关闭订阅
+func (engine *DBEngine) unwatch(id uint64) {
+	engine.watchMu.Lock()
+	defer engine.watchMu.Unlock()
+	engine.closeWatcher(id)
+}
+
+// closeWatcher 关闭订阅，调用方需持有watchMu
+func (engine *DBEngine) closeWatcher(id uint64) {
+	w, ok := engine.watchers[id]
+	if !ok {
+		return
+	}
+	delete(engine.watchers, id)
+	close(w.ch)
+	close(w.done)
+}
+
+// closeWatchers 关闭全部订阅(引擎关闭时使用)
+func (engine *DBEngine) closeWatchers() {
+	engine.watchMu.Lock()
+	defer engine.watchMu.Unlock()
+	for id := range engine.watchers {
+		engine.closeWatcher(id)
+	}
+}
+
+// watching 是否存在订阅者
+func (engine *DBEngine) watching() bool {
+	engine.watchMu.Lock()
+	defer engine.watchMu.Unlock()
+	return len(engine.watchers) > 0
+}
+
+// notify 为写入成功的记录生成事件并发送给订阅者；调用方需持有segFMu
+func (engine *DBEngine) notify(segs []*Segment) {
+	if !engine.watching() {
+		return
+	}
+	events := make([]Event, 0, len(segs))
+	for _, seg := range segs {
+		event := Event{Type: EventPut, Key: seg.key, Seq: seg.seq}
+		kind := seg.kind &^ FlagBatch
+		switch {
+		case kind == KindCommit || kind == KindDropBucket || kind&FlagMoved != 0:
+			continue
+		case seg.valsz == 0:
+			event.Type = EventDelete
+		case kind == KindVal:
+			value, err := engine.decodeVal(seg.key, []byte(seg.value), seg.codec, seg.keyID)
+			if err != nil {
+				slogger.Errorf("watch idxK: %s, decode value error: %v", seg.key, err)
+			}
+			event.Value = value
+		case kind == KindMerge || kind == KindBlob:
+			value, err := engine.seekKey(seg.key, segment2MemIndex(seg, engine.segFName).idxV)
+			if err != nil {
+				slogger.Errorf("watch idxK: %s, read value error: %v", seg.key, err)
+			}
+			event.Value = value
+		}
+		events = append(events, event)
+	}
+	engine.watchMu.Lock()
+	defer engine.watchMu.Unlock()
+	for id, w := range engine.watchers {
+		for _, event := range events {
+			if !strings.HasPrefix(event.Key, w.prefix) || (isInternalKey(event.Key) && !isInternalKey(w.prefix)) {
+				continue
+			}
+			// 预留一个位置用于发送EventOverflow事件
+			if len(w.ch) >= cap(w.ch)-1 {
+				w.ch <- Event{Type: EventOverflow, Seq: event.Seq}
+				engine.closeWatcher(id)
+				break
+			}
+			w.ch <- event
+		}
+	}
+}